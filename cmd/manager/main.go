@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/lcpu-club/hpcgame-judger/internal/config"
 	"github.com/lcpu-club/hpcgame-judger/internal/manager"
@@ -33,13 +37,28 @@ func main() {
 	conf.KubeSecretPath = flag.String("kube-secret-path", "/var/run/secrets/kubernetes.io/serviceaccount", "Path to the Kubernetes service account token")
 	conf.RedisConfig = flag.String("redis-config", "redis://", "Redis configuration")
 	conf.SharedVolumePath = flag.String("shared-volume-path", "/data", "Path to shared volume")
+	conf.CacheProblemData = flag.Bool("cache-problem-data", false, "Download and verify problem data once into the shared volume")
+	conf.ProblemDataClaim = flag.String("problem-data-claim", "", "PVC in judge namespaces backed by the shared volume, cached problem data is mounted from it if set")
 	conf.Endpoint = flag.String("endpoint", defaultValue(os.Getenv("ENDPOINT"), "https://hpcgame.pku.edu.cn"), "API endpoint")
 	conf.RunnerID = flag.String("runner-id", os.Getenv("RUNNER_ID"), "Runner ID")
 	conf.RunnerKey = flag.String("runner-key", os.Getenv("RUNNER_KEY"), "Runner Key")
 	conf.RateLimit = flag.Int64("rate-limit", 64, "Rate limit")
+	conf.QueueSize = flag.Int64("queue-size", 256, "Stop polling while this many solutions are waiting in the admission queue")
+	conf.MaxAttempts = flag.Int64("max-attempts", 3, "Maximum number of attempts of a session failed with transient errors")
+	conf.RetryBackoff = flag.Duration("retry-backoff", 10*time.Second, "Initial backoff before retrying a session, doubled on each attempt")
+	conf.PoolLimits = flag.String("pool-limits", "", "Concurrency pool limits, e.g. \"multi-node=2,small=32\"")
+	conf.DrainTimeout = flag.Duration("drain-timeout", 30*time.Second, "Time given to running sessions to finish on shutdown before handing them off")
+	conf.RecoveryInterval = flag.Duration("recovery-interval", 8*time.Minute, "Interval of the leader queuing again the sessions no replica owns")
+	conf.GCInterval = flag.Duration("gc-interval", 10*time.Minute, "Interval of deleting orphan judge namespaces (0 to disable)")
+	conf.GCGracePeriod = flag.Duration("gc-grace-period", time.Hour, "Age of a judge namespace without a session before it's deleted")
 	conf.TLSCertFile = flag.String("tls-cert-file", "", "TLS certificate file (empty to disable TLS)")
 	conf.TLSKeyFile = flag.String("tls-key-file", "", "TLS key file (empty to disable TLS)")
+	conf.AdminToken = flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token of the admin API (empty to disable)")
 	conf.TemplatePath = flag.String("template-path", "/templates", "Path to namespace template files")
+	conf.PolicyFile = flag.String("policy", "", "Admission policy of judge jobs and namespace objects (empty for the default, which forbids escaping to the node and privileges beyond the baseline)")
+	conf.Executor = flag.String("executor", manager.ExecutorKubernetes, "Execution backend (kubernetes or local)")
+	conf.LocalCommand = flag.String("local-command", "", "Judge command to run with the local executor")
+	conf.LocalWorkDir = flag.String("local-work-dir", os.TempDir(), "Work directory of the local executor")
 
 	flag.Parse()
 
@@ -50,7 +69,10 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	err = s.Start()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	err = s.Start(ctx)
 	if err != nil {
 		log.Fatalln(err)
 	}
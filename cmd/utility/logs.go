@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/urfave/cli/v2"
+)
+
+func logsCommand(app *cli.App) {
+	app.Commands = append(app.Commands, &cli.Command{
+		Name:      "logs",
+		Usage:     "Print the judge logs of a session",
+		ArgsUsage: "<session ID>",
+		Action:    logsHandler,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "manager",
+				Aliases:     []string{"m"},
+				Usage:       "Manager API endpoint",
+				Value:       "http://localhost:8080",
+				DefaultText: "http://localhost:8080",
+				EnvVars:     []string{"MANAGER_ENDPOINT"},
+			},
+			&cli.StringFlag{
+				Name:    "admin-token",
+				Usage:   "Admin token of the manager",
+				EnvVars: []string{"ADMIN_TOKEN"},
+			},
+			&cli.BoolFlag{
+				Name:    "follow",
+				Aliases: []string{"f"},
+				Usage:   "Keep printing new logs until the session is over",
+			},
+		},
+	})
+}
+
+func logsHandler(c *cli.Context) error {
+	id := c.Args().First()
+	if id == "" {
+		return fmt.Errorf("session ID is required")
+	}
+
+	u := c.String("manager") + "/api/sessions/" + url.PathEscape(id) + "/logs"
+	if c.Bool("follow") {
+		u += "?follow=true"
+	}
+
+	req, err := http.NewRequestWithContext(c.Context, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.String("admin-token"))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s", res.Status, msg)
+	}
+
+	_, err = io.Copy(os.Stdout, res.Body)
+	return err
+}
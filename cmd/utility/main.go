@@ -49,6 +49,8 @@ func main() {
 
 	registerCommand(app)
 	pollCommand(app)
+	logsCommand(app)
+	renderCommand(app)
 
 	err := app.Run(os.Args)
 	if err != nil {
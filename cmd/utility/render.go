@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/lcpu-club/hpcgame-judger/internal/kube"
+	"github.com/lcpu-club/hpcgame-judger/internal/manager"
+	"github.com/lcpu-club/hpcgame-judger/internal/policy"
+	"github.com/lcpu-club/hpcgame-judger/pkg/aoiclient"
+	"github.com/urfave/cli/v2"
+	"sigs.k8s.io/yaml"
+)
+
+func renderCommand(app *cli.App) {
+	app.Commands = append(app.Commands, &cli.Command{
+		Name:   "render",
+		Usage:  "Print the Kubernetes objects of a problem as submitted by the manager",
+		Action: renderHandler,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "templates",
+				Aliases:  []string{"t"},
+				Usage:    "Namespace template directory",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "config",
+				Aliases:  []string{"c"},
+				Usage:    "Judge config of the problem (RunningConfig JSON)",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:    "solution",
+				Aliases: []string{"s"},
+				Usage:   "Solution poll JSON (a fake one if not set)",
+			},
+			&cli.BoolFlag{
+				Name:  "validate",
+				Usage: "Validate the objects against the Kubernetes schemas",
+			},
+			&cli.StringFlag{
+				Name:  "policy",
+				Usage: "Check the objects against the admission policy file of the manager",
+			},
+		},
+	})
+}
+
+func readJSON(file string, v interface{}) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+func renderHandler(c *cli.Context) error {
+	ts, err := manager.LoadTemplateSet(c.String("templates"))
+	if err != nil {
+		return err
+	}
+
+	rc := new(manager.RunningConfig)
+	err = readJSON(c.String("config"), rc)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	soln := &aoiclient.SolutionPoll{
+		TaskId:          "render-task",
+		SolutionId:      "render-solution",
+		UserId:          "render-user",
+		ContestId:       "render-contest",
+		SolutionDataUrl: "https://example.com/solution.zip",
+	}
+	if c.String("solution") != "" {
+		err = readJSON(c.String("solution"), soln)
+		if err != nil {
+			return fmt.Errorf("solution: %w", err)
+		}
+	}
+
+	rs, err := manager.RenderSession(ts, rc, soln, "render-manager")
+	if err != nil {
+		return err
+	}
+
+	docs := rs.Objects
+	for _, job := range rs.Jobs {
+		b, err := yaml.Marshal(job)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, string(b))
+	}
+
+	var out strings.Builder
+	for _, doc := range docs {
+		for _, obj := range kube.SplitDocuments(doc) {
+			obj = strings.TrimPrefix(strings.TrimLeft(obj, "\n"), "---\n")
+			out.WriteString("---\n")
+			out.WriteString(obj)
+			if !strings.HasSuffix(obj, "\n") {
+				out.WriteString("\n")
+			}
+		}
+	}
+	fmt.Print(out.String())
+
+	if c.Bool("validate") {
+		// Unknown fields are dropped once parsed, check the raw ones
+		err = validateJobTemplates(c.String("config"))
+		if err != nil {
+			return err
+		}
+
+		unchecked, err := kube.Validate(out.String())
+		if err != nil {
+			return fmt.Errorf("invalid object: %w", err)
+		}
+		for _, obj := range unchecked {
+			log.Println("Not validated, unknown kind:", obj)
+		}
+		log.Println("All objects are valid")
+	}
+
+	if c.String("policy") != "" {
+		p, err := policy.Load(c.String("policy"))
+		if err != nil {
+			return err
+		}
+		err = manager.CheckPolicy(p, rs.Objects, rs.Jobs)
+		if err != nil {
+			return err
+		}
+		log.Println("All objects comply with the policy")
+	}
+
+	return nil
+}
+
+// validateJobTemplates validates the job templates in the raw config
+func validateJobTemplates(file string) error {
+	var raw struct {
+		JobTemplate map[string]interface{} `json:"jobTemplate"`
+		Stages      []struct {
+			Name        string                 `json:"name"`
+			JobTemplate map[string]interface{} `json:"jobTemplate"`
+		} `json:"stages"`
+	}
+	err := readJSON(file, &raw)
+	if err != nil {
+		return err
+	}
+
+	tmpls := map[string]map[string]interface{}{"jobTemplate": raw.JobTemplate}
+	for _, stage := range raw.Stages {
+		tmpls["stage "+stage.Name] = stage.JobTemplate
+	}
+
+	for name, tmpl := range tmpls {
+		if tmpl == nil {
+			continue
+		}
+		tmpl["apiVersion"] = "batch/v1"
+		tmpl["kind"] = "Job"
+
+		b, err := yaml.Marshal(tmpl)
+		if err != nil {
+			return err
+		}
+		_, err = kube.Validate(string(b))
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
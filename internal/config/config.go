@@ -1,5 +1,7 @@
 package config
 
+import "time"
+
 type ManagerConfig struct {
 	Listen     *string
 	Kubernetes *string
@@ -8,14 +10,35 @@ type ManagerConfig struct {
 	RunnerID  *string
 	RunnerKey *string
 	RateLimit *int64
+	QueueSize *int64
+
+	PoolLimits *string
+
+	DrainTimeout *time.Duration
+	MaxAttempts  *int64
+	RetryBackoff *time.Duration
+
+	RecoveryInterval *time.Duration
+
+	GCInterval    *time.Duration
+	GCGracePeriod *time.Duration
 
 	RedisConfig      *string
 	SharedVolumePath *string
 
+	CacheProblemData *bool
+	ProblemDataClaim *string
+
 	KubeSecretPath *string
 
 	TLSCertFile *string
 	TLSKeyFile  *string
+	AdminToken  *string
 
 	TemplatePath *string
+	PolicyFile   *string
+
+	Executor     *string
+	LocalCommand *string
+	LocalWorkDir *string
 }
@@ -16,18 +16,7 @@ func trimBlank(str string) string {
 }
 
 func (c *Client) strToStrSlice(str string) []string {
-	var rslt []string
-
-	// Delim by yaml's --- rule
-	for _, s := range strings.Split(str, "\n---") {
-		if trimBlank(s) == "" {
-			continue
-		}
-
-		rslt = append(rslt, s)
-	}
-
-	return rslt
+	return SplitDocuments(str)
 }
 
 func (c *Client) strToResource(str string) (
@@ -131,6 +120,9 @@ func (c *Client) Update(ctx context.Context, str string, continueOnFailure bool)
 	return errors.Join(errs...)
 }
 
+// fieldManager owns the fields set by Apply
+const fieldManager = "hpcgame-judger"
+
 func (c *Client) applyItem(ctx context.Context, str string) error {
 	res, obj, err := c.strToResource(str)
 	if err != nil {
@@ -139,7 +131,10 @@ func (c *Client) applyItem(ctx context.Context, str string) error {
 
 	_, err = c.dc.Resource(res).
 		Namespace(obj.GetNamespace()).
-		Apply(ctx, obj.GetName(), obj, metav1.ApplyOptions{})
+		Apply(ctx, obj.GetName(), obj, metav1.ApplyOptions{
+			FieldManager: fieldManager,
+			Force:        true,
+		})
 	return err
 }
 
@@ -0,0 +1,60 @@
+package kube
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/serializer/json"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// SplitDocuments splits a YAML string by the --- separators
+func SplitDocuments(str string) []string {
+	var rslt []string
+
+	// Delim by yaml's --- rule
+	for _, s := range strings.Split(str, "\n---") {
+		if trimBlank(s) == "" {
+			continue
+		}
+
+		rslt = append(rslt, s)
+	}
+
+	return rslt
+}
+
+var strictSerializer = json.NewSerializerWithOptions(json.DefaultMetaFactory, scheme.Scheme, scheme.Scheme,
+	json.SerializerOptions{Yaml: true, Strict: true})
+
+// Validate checks the objects in str against the schemas of the built-in
+// kinds without a cluster, including unknown and duplicate fields. Objects
+// of other kinds, e.g. custom resources, can't be checked and are returned.
+func Validate(str string) ([]string, error) {
+	var unchecked []string
+
+	for i, doc := range SplitDocuments(str) {
+		obj := unstructured.Unstructured{}
+		_, gvk, err := scheme.Codecs.UniversalDeserializer().Decode([]byte(doc), nil, &obj)
+		if err != nil {
+			return nil, fmt.Errorf("object %d: %w", i, err)
+		}
+
+		if !scheme.Scheme.Recognizes(*gvk) {
+			unchecked = append(unchecked, fmt.Sprintf("%s %s", gvk.Kind, obj.GetName()))
+			continue
+		}
+
+		typed, err := scheme.Scheme.New(*gvk)
+		if err != nil {
+			return nil, err
+		}
+		_, _, err = strictSerializer.Decode([]byte(doc), gvk, typed)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", gvk.Kind, obj.GetName(), err)
+		}
+	}
+
+	return unchecked, nil
+}
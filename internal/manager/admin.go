@@ -0,0 +1,381 @@
+package manager
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lcpu-club/hpcgame-judger/pkg/aoiclient"
+	"github.com/redis/go-redis/v9"
+)
+
+func (m *Manager) registerAdminAPI(mux *http.ServeMux) {
+	mux.Handle("GET /api/sessions", m.adminAuth(m.handleListSessions))
+	mux.Handle("GET /api/sessions/{id}", m.adminAuth(m.handleGetSession))
+	mux.Handle("POST /api/sessions/{id}/cancel", m.adminAuth(m.handleCancelSession))
+	mux.Handle("POST /api/sessions/{id}/requeue", m.adminAuth(m.handleRequeueSession))
+	mux.Handle("GET /api/sessions/{id}/logs", m.adminAuth(m.handleSessionLogs))
+	mux.Handle("GET /api/ratelimit", m.adminAuth(m.handleRateLimit))
+	mux.Handle("GET /api/queue", m.adminAuth(m.handleQueue))
+	mux.Handle("PUT /api/queue/weights/{contest}", m.adminAuth(m.handleSetQueueWeight))
+	mux.Handle("GET /api/gc", m.adminAuth(m.handleGC))
+}
+
+func (m *Manager) adminAuth(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := *m.conf.AdminToken
+		if token == "" {
+			http.Error(w, "admin API is disabled", http.StatusForbidden)
+			return
+		}
+
+		auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+// sessionIDOf returns the session in the path, which must be the key of a
+// solution, soln:<solution>:<task>
+func sessionIDOf(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id := r.PathValue("id")
+	rest, ok := strings.CutPrefix(id, solnKeyPrefix)
+	solution, task, found := strings.Cut(rest, ":")
+	if !ok || !found || solution == "" || task == "" || strings.Contains(task, ":") {
+		http.Error(w, "invalid session ID", http.StatusBadRequest)
+		return "", false
+	}
+	return id, true
+}
+
+type sessionInfo struct {
+	ID         string     `json:"id"`
+	SolutionID string     `json:"solutionId"`
+	TaskID     string     `json:"taskId"`
+	UserID     string     `json:"userId"`
+	ContestID  string     `json:"contestId"`
+	Owner      string     `json:"owner,omitempty"`
+	Queued     bool       `json:"queued"`
+	Processed  *time.Time `json:"processed,omitempty"`
+
+	Solution *aoiclient.SolutionPoll `json:"solution,omitempty"`
+}
+
+func (m *Manager) getSessionInfo(id string) (*sessionInfo, error) {
+	soln, err := m.r.GetSolutionPoll(id)
+	if err != nil {
+		return nil, err
+	}
+
+	owner, err := m.r.GetLockOwner(lockKeyOf(id))
+	if err != nil {
+		return nil, err
+	}
+
+	queued, err := m.q.IsQueued(id)
+	if err != nil {
+		return nil, err
+	}
+
+	processed, err := m.getProcessedTimestamp(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sessionInfo{
+		ID:         id,
+		SolutionID: soln.SolutionId,
+		TaskID:     soln.TaskId,
+		UserID:     soln.UserId,
+		ContestID:  soln.ContestId,
+		Owner:      owner,
+		Queued:     queued,
+		Processed:  processed,
+		Solution:   soln,
+	}, nil
+}
+
+func (m *Manager) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	ids, err := m.r.ListSolutionPoll()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sessions := []*sessionInfo{}
+	for _, id := range ids {
+		info, err := m.getSessionInfo(id)
+		if err == redis.Nil {
+			// Finished while listing
+			continue
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		info.Solution = nil
+		sessions = append(sessions, info)
+	}
+
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func (m *Manager) handleGetSession(w http.ResponseWriter, r *http.Request) {
+	id, ok := sessionIDOf(w, r)
+	if !ok {
+		return
+	}
+
+	info, err := m.getSessionInfo(id)
+	if err == redis.Nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (m *Manager) handleCancelSession(w http.ResponseWriter, r *http.Request) {
+	id, ok := sessionIDOf(w, r)
+	if !ok {
+		return
+	}
+
+	locked, err := m.isLocked(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !locked {
+		err = m.cancelIdleSession(id)
+		if err == redis.Nil {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			writeJSON(w, http.StatusOK, map[string]string{"status": "cancelled"})
+			return
+		}
+		if err != errSessionLocked {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Picked up in the meantime, let the owner cancel it
+	}
+
+	err = m.publishEvent(&event{Type: eventCancel, ID: id})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "cancelling"})
+}
+
+// cancelIdleSession cancels a session which is not running on any manager
+func (m *Manager) cancelIdleSession(id string) error {
+	sess, err := NewJudgeSession(id, m)
+	if err != nil {
+		return err
+	}
+
+	ok, err := sess.tryLock()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errSessionLocked
+	}
+
+	sess.Stop(errSessionCancelled)
+	sess.runningCleanup()
+
+	err = m.q.Remove(id, sess.soln)
+	if err != nil {
+		log.Println("Failed to remove from queue:", err)
+	}
+
+	err = m.failSoln(sess.soln, aoiclient.StatusError, "Judging cancelled by administrator")
+	if err != nil {
+		log.Println("Failed to fail solution:", err)
+	}
+
+	return sess.cleanup()
+}
+
+// handleRequeueSession starts a session over through the admission queue.
+// A running session is stopped by its owner, which queues it again.
+func (m *Manager) handleRequeueSession(w http.ResponseWriter, r *http.Request) {
+	id, ok := sessionIDOf(w, r)
+	if !ok {
+		return
+	}
+
+	locked, err := m.isLocked(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if locked {
+		err = m.publishEvent(&event{Type: eventRequeue, ID: id})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "requeuing"})
+		return
+	}
+
+	// Owned by the queue or about to run otherwise
+	ok, err = m.claimSession(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "session is queued or owned by a manager", http.StatusConflict)
+		return
+	}
+	defer m.releaseClaim(id)
+
+	soln, err := m.r.GetSolutionPoll(id)
+	if err == redis.Nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Start over from the beginning
+	err = m.deleteProcessedTimestamp(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = m.deleteStage(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = m.q.Push(id, soln)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "requeued"})
+}
+
+type rateLimitInfo struct {
+	Current int64 `json:"current"`
+	Total   int64 `json:"total"`
+
+	Leases []*leaseInfo `json:"leases"`
+
+	Pools map[string]*rateLimitInfo `json:"pools,omitempty"`
+}
+
+func rateLimitInfoOf(rl *RateLimiter) (*rateLimitInfo, error) {
+	current, err := rl.Current()
+	if err != nil {
+		return nil, err
+	}
+
+	total, err := rl.Total()
+	if err != nil {
+		return nil, err
+	}
+
+	leases, err := rl.Holders()
+	if err != nil {
+		return nil, err
+	}
+
+	return &rateLimitInfo{
+		Current: current,
+		Total:   total,
+		Leases:  leases,
+	}, nil
+}
+
+func (m *Manager) handleRateLimit(w http.ResponseWriter, r *http.Request) {
+	info, err := rateLimitInfoOf(m.rl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	info.Pools = make(map[string]*rateLimitInfo)
+	for name, pool := range m.pools {
+		info.Pools[name], err = rateLimitInfoOf(pool)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (m *Manager) handleQueue(w http.ResponseWriter, r *http.Request) {
+	stats, err := m.q.Stats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+type queueWeightRequest struct {
+	Weight int64 `json:"weight"`
+}
+
+func (m *Manager) handleSetQueueWeight(w http.ResponseWriter, r *http.Request) {
+	req := &queueWeightRequest{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Weight < 1 {
+		http.Error(w, "weight must be positive", http.StatusBadRequest)
+		return
+	}
+
+	err = m.q.SetWeight(r.PathValue("contest"), req.Weight)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, req)
+}
+
+func (m *Manager) handleGC(w http.ResponseWriter, r *http.Request) {
+	report := m.lastGC.Load()
+	if report == nil {
+		http.Error(w, "no garbage collection yet", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,90 @@
+package manager
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// A session is owned by the replica holding its lock while it's running,
+// by the queue while it's queued, and by the replica holding its claim in
+// between, e.g. from being popped until it's locked, or while waiting to be
+// retried. Recovery only takes over sessions owned by none of them.
+const (
+	claimKeyPrefix = "judge:claim:"
+
+	claimTimeout       = time.Minute
+	claimRenewInterval = 20 * time.Second
+)
+
+func claimKeyOf(id string) string {
+	return claimKeyPrefix + id
+}
+
+// claimSession claims the session for this manager if no one owns it
+func (m *Manager) claimSession(id string) (bool, error) {
+	script := `
+	local lock, pending, claim = KEYS[1], KEYS[2], KEYS[3]
+	local id, owner, ttl = ARGV[1], ARGV[2], ARGV[3]
+
+	if redis.call('EXISTS', lock) == 1 or redis.call('SISMEMBER', pending, id) == 1 then
+		return 0
+	end
+
+	if not redis.call('SET', claim, owner, 'NX', 'PX', ttl) then
+		return 0
+	end
+	return 1
+	`
+
+	res, err := m.r.Eval(context.TODO(), script,
+		[]string{lockKeyOf(id), m.q.key("pending"), claimKeyOf(id)},
+		id, m.ID(), claimTimeout.Milliseconds()).Int()
+	return res == 1, err
+}
+
+// renewClaim extends the claim, it returns false if it's no longer ours
+func (m *Manager) renewClaim(id string) (bool, error) {
+	script := `
+	if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+		return 0
+	end
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+	`
+
+	res, err := m.r.Eval(context.TODO(), script, []string{claimKeyOf(id)},
+		m.ID(), claimTimeout.Milliseconds()).Int()
+	return res == 1, err
+}
+
+// releaseClaim drops the claim if it's ours
+func (m *Manager) releaseClaim(id string) {
+	err := m.r.ReleaseLock(claimKeyOf(id), m.ID())
+	if err != nil && err != redis.Nil && err != redis.TxFailedErr {
+		log.Println("Failed to release claim:", err)
+	}
+}
+
+// keepClaim renews the claim until stop is closed
+func (m *Manager) keepClaim(id string, stop <-chan struct{}) {
+	ticker := time.NewTicker(claimRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		ok, err := m.renewClaim(id)
+		if err != nil {
+			log.Println("Failed to renew claim:", err)
+		} else if !ok {
+			log.Println("Claim of", id, "is lost")
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package manager
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/lcpu-club/hpcgame-judger/pkg/aoiclient"
+)
+
+// Problem data is downloaded once per hash to the shared volume, under
+// problems/<hash>/data, and verified against the hash before it's moved in
+// place. Judges find it at PROBLEM_DATA_PATH instead of downloading it.
+const (
+	problemDataDir  = "problems"
+	problemDataFile = "data"
+
+	problemDataVolumeName = "problem-data"
+	problemDataMountPath  = "/problem"
+)
+
+var errProblemDataHashMismatch = errors.New("problem data hash mismatch")
+
+// dataCache fills the cache, a download is shared by the sessions of this
+// manager waiting for the same hash
+type dataCache struct {
+	root string
+
+	lock  *sync.Mutex
+	fills map[string]*dataFill
+}
+
+type dataFill struct {
+	done chan struct{}
+	err  error
+}
+
+func newDataCache(root string) *dataCache {
+	return &dataCache{
+		root:  filepath.Join(root, problemDataDir),
+		lock:  &sync.Mutex{},
+		fills: make(map[string]*dataFill),
+	}
+}
+
+// isHash reports whether hash is a hex SHA-256 digest, which is also safe
+// to use as a file name
+func isHash(hash string) bool {
+	b, err := hex.DecodeString(hash)
+	return err == nil && len(b) == sha256.Size
+}
+
+// path returns the cached directory of hash
+func (c *dataCache) path(hash string) string {
+	return filepath.Join(c.root, hash)
+}
+
+// prepare returns the cached directory of hash, downloading url first if
+// it's not cached yet
+func (c *dataCache) prepare(ctx context.Context, url string, hash string) (string, error) {
+	if !isHash(hash) {
+		return "", fmt.Errorf("invalid problem data hash: %s", hash)
+	}
+
+	dir := c.path(hash)
+	if _, err := os.Stat(dir); err == nil {
+		metricProblemData.WithLabelValues("hit").Inc()
+		return dir, nil
+	}
+
+	c.lock.Lock()
+	fill, ok := c.fills[hash]
+	if !ok {
+		fill = &dataFill{done: make(chan struct{})}
+		c.fills[hash] = fill
+
+		go func() {
+			// Not bound to ctx, others may be waiting for it as well
+			fill.err = c.download(context.Background(), url, hash)
+			if fill.err != nil {
+				metricProblemData.WithLabelValues("failure").Inc()
+			} else {
+				metricProblemData.WithLabelValues("download").Inc()
+			}
+
+			c.lock.Lock()
+			delete(c.fills, hash)
+			c.lock.Unlock()
+			close(fill.done)
+		}()
+	}
+	c.lock.Unlock()
+
+	select {
+	case <-fill.done:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	if fill.err != nil {
+		return "", fill.err
+	}
+	return dir, nil
+}
+
+// download fetches url into the cache, the cached directory only appears
+// once it's complete and verified
+func (c *dataCache) download(ctx context.Context, url string, hash string) error {
+	tmpRoot := filepath.Join(c.root, ".tmp")
+	err := os.MkdirAll(tmpRoot, 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp(tmpRoot, hash+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return &aoiclient.APIError{
+			StatusCode: res.StatusCode,
+			Message:    "failed to download problem data: " + res.Status,
+		}
+	}
+
+	f, err := os.Create(filepath.Join(tmp, problemDataFile))
+	if err != nil {
+		return err
+	}
+
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hasher), res.Body)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != hash {
+		return fmt.Errorf("%w: got %s, expected %s", errProblemDataHashMismatch, sum, hash)
+	}
+
+	err = os.Chmod(tmp, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, c.path(hash))
+	if err != nil {
+		// Filled by another replica in the meantime
+		if _, sErr := os.Stat(c.path(hash)); sErr == nil {
+			return nil
+		}
+		return err
+	}
+
+	log.Println("Cached", n, "bytes of problem data", hash)
+	return nil
+}
+
+// prepareProblemData caches the problem data of the session if enabled.
+// Data with other kinds of hashes isn't cached, the judge downloads it
+// directly as before.
+func (s *JudgeSession) prepareProblemData() error {
+	if s.m.data == nil || s.soln.ProblemDataUrl == "" || s.soln.ProblemDataHash == "" {
+		return nil
+	}
+	if !isHash(s.soln.ProblemDataHash) {
+		log.Println("Not caching problem data of", s.id, "with non SHA-256 hash", s.soln.ProblemDataHash)
+		metricProblemData.WithLabelValues("skip").Inc()
+		return nil
+	}
+
+	dir, err := s.m.data.prepare(s.ctx, s.soln.ProblemDataUrl, s.soln.ProblemDataHash)
+	if err != nil {
+		if errors.Is(err, errProblemDataHashMismatch) {
+			return newStatusError(aoiclient.StatusError, "Failed to verify problem data: %v", err)
+		}
+		return err
+	}
+
+	s.problemData = dir
+	return nil
+}
+
+// ProblemDataVolume is where judge pods mount the cached problem data from
+type ProblemDataVolume struct {
+	// PersistentVolumeClaim in the judge namespace backed by the shared volume
+	ClaimName string
+	// Cached directory relative to the root of the claim
+	SubPath string
+}
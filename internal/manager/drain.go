@@ -0,0 +1,160 @@
+package manager
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	stateRunning int32 = iota
+	// No more polling, sessions are given time to finish
+	stateDraining
+	// Remaining sessions are handed off to other replicas
+	stateHandingOff
+)
+
+const (
+	handOffTimeout = 5 * time.Second
+	// Within handOffTimeout, so that the fallback is done before exiting
+	adoptTimeout = 2 * time.Second
+)
+
+// drain is called once polling is stopped. Running sessions are given
+// DrainTimeout to finish, the rest are handed off to other replicas, which
+// releases their locks and rate limit tokens right away
+func (m *Manager) drain() {
+	// No more runs are started once it's waited for
+	m.runsLock.Lock()
+	m.state.Store(stateDraining)
+	m.runsLock.Unlock()
+
+	log.Println("Draining", len(m.listSessions()), "sessions")
+	if waitTimeout(m.runs, *m.conf.DrainTimeout) {
+		log.Println("All sessions finished")
+		return
+	}
+
+	m.state.Store(stateHandingOff)
+	close(m.handOffChan)
+
+	sessions := m.listSessions()
+	log.Println("Handing off", len(sessions), "sessions")
+	for _, s := range sessions {
+		s.Stop(errSessionHandedOff)
+	}
+
+	if !waitTimeout(m.runs, handOffTimeout) {
+		log.Println("Timed out handing off sessions")
+	}
+}
+
+// adoptSession takes over a session handed off by another replica
+func (m *Manager) adoptSession(id string) {
+	if m.state.Load() != stateRunning {
+		return
+	}
+
+	// Only one replica gets it
+	ok, err := m.claimSession(id)
+	if err != nil {
+		log.Println("Failed to claim session:", err)
+	}
+	if err != nil || !ok {
+		return
+	}
+
+	lease, err := m.rl.Request()
+	if err != nil {
+		log.Println("Failed to request rate limit:", err)
+	}
+	if err != nil || lease == nil {
+		m.queueAdopted(id)
+		return
+	}
+
+	soln, err := m.r.GetSolutionPoll(id)
+	if err != nil {
+		log.Println("Failed to get solution:", err)
+		lease.Release()
+		m.releaseClaim(id)
+		return
+	}
+
+	poolLease, ok, err := m.requestPool(m.poolNameOf(soln))
+	if err != nil {
+		log.Println("Failed to request pool:", err)
+	}
+	if err != nil || !ok {
+		lease.Release()
+		m.queueAdopted(id)
+		return
+	}
+
+	log.Println("Adopting session", id)
+	if !m.goRun(id, lease, poolLease) {
+		releaseLeases([]*Lease{lease, poolLease})
+		m.queueAdopted(id)
+	}
+}
+
+// handOff puts the session up for adoption by the other replicas. If none
+// adopts it within adoptTimeout, e.g. as all of them are draining, it's
+// queued again instead of waiting for the recovery.
+func (m *Manager) handOff(id string) {
+	m.releaseClaim(id)
+	err := m.publishEvent(&event{Type: eventHandoff, ID: id})
+	if err != nil {
+		log.Println("Failed to publish hand off:", err)
+	} else {
+		time.Sleep(adoptTimeout)
+	}
+
+	// Owned by the adopter or the queue otherwise
+	ok, err := m.claimSession(id)
+	if err != nil {
+		log.Println("Failed to claim session:", err)
+	}
+	if err != nil || !ok {
+		return
+	}
+
+	log.Println("Session", id, "is not adopted, queueing it")
+	m.queueAdopted(id)
+}
+
+// queueAdopted queues a claimed session which can't be run here for now
+func (m *Manager) queueAdopted(id string) {
+	err := m.requeueClaimed(id)
+	if err != nil {
+		log.Println("Failed to queue solution:", err)
+	}
+	m.releaseClaim(id)
+}
+
+// sleepUnlessHandingOff sleeps for d, it returns false if interrupted by
+// the hand off
+func (m *Manager) sleepUnlessHandingOff(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-m.handOffChan:
+		return false
+	}
+}
+
+// waitTimeout waits for wg, it returns false if timed out
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
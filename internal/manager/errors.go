@@ -0,0 +1,94 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/lcpu-club/hpcgame-judger/pkg/aoiclient"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// statusError fails the solution with a specific status instead of
+// aoiclient.StatusError
+type statusError struct {
+	status string
+	msg    string
+}
+
+func newStatusError(status string, format string, a ...interface{}) *statusError {
+	return &statusError{
+		status: status,
+		msg:    fmt.Sprintf(format, a...),
+	}
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+// statusOf returns the status to report for err and whether it's a
+// statusError, whose message is meant to be shown as is
+func statusOf(err error) (string, bool) {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.status, true
+	}
+	return aoiclient.StatusError, false
+}
+
+var errWatchClosed = errors.New("watcher channel closed unexpectedly")
+
+// isTransient reports whether err is caused by an infrastructure hiccup,
+// so that running the session again may succeed
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if _, ok := statusOf(err); ok {
+		return false
+	}
+
+	var apiErr *aoiclient.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= http.StatusInternalServerError ||
+			apiErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	if apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) || apierrors.IsInternalError(err) ||
+		apierrors.IsServiceUnavailable(err) || apierrors.IsUnexpectedServerError(err) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return errors.Is(err, errWatchClosed) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// retryError stops a session failed with a transient error, which is
+// going to be run again
+type retryError struct {
+	err     error
+	attempt int64
+}
+
+func (e *retryError) Error() string {
+	return "transient error: " + e.err.Error()
+}
+
+func (e *retryError) Unwrap() error {
+	return e.err
+}
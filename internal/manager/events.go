@@ -0,0 +1,90 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Events are broadcast to every manager replica through Redis pub/sub,
+// the replica owning the session is responsible for handling them
+const eventsChannel = "judge:events"
+
+type eventType string
+
+const (
+	eventCancel  eventType = "cancel"
+	eventRequeue eventType = "requeue"
+	eventHandoff eventType = "handoff"
+)
+
+type event struct {
+	Type eventType `json:"type"`
+	ID   string    `json:"id"`
+}
+
+func (m *Manager) publishEvent(e *event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return m.r.Publish(context.TODO(), eventsChannel, b).Err()
+}
+
+const eventLoopRetryInterval = 5 * time.Second
+
+func (m *Manager) eventLoop() {
+	for {
+		err := m.receiveEvents()
+		if err != nil {
+			log.Println("Failed to receive events:", err)
+		}
+		time.Sleep(eventLoopRetryInterval)
+	}
+}
+
+func (m *Manager) receiveEvents() error {
+	sub := m.r.Subscribe(context.TODO(), eventsChannel)
+	defer sub.Close()
+
+	for {
+		msg, err := sub.ReceiveMessage(context.TODO())
+		if err != nil {
+			return err
+		}
+
+		e := &event{}
+		err = json.Unmarshal([]byte(msg.Payload), e)
+		if err != nil {
+			log.Println("Failed to unmarshal event:", err)
+			continue
+		}
+
+		m.handleEvent(e)
+	}
+}
+
+func (m *Manager) handleEvent(e *event) {
+	if e.Type == eventHandoff {
+		m.adoptSession(e.ID)
+		return
+	}
+
+	sess := m.getSession(e.ID)
+	if sess == nil {
+		// Not running on this manager
+		return
+	}
+
+	switch e.Type {
+	case eventCancel:
+		log.Println("Cancelling session", e.ID)
+		sess.Stop(errSessionCancelled)
+	case eventRequeue:
+		log.Println("Requeuing session", e.ID)
+		sess.Stop(errSessionRequeued)
+	default:
+		log.Println("Unknown event type:", e.Type)
+	}
+}
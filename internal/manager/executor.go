@@ -0,0 +1,59 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+)
+
+// Executor is the backend that actually runs the judge workload of a
+// session, stage by stage. All methods must be idempotent, since a session
+// recovered by findNotRunning goes through every step again.
+type Executor interface {
+	// Provision prepares the environment of the session (e.g. namespace)
+	Provision(ctx context.Context, s *JudgeSession) error
+	// Start starts the workload of the stage if it's not started yet
+	Start(ctx context.Context, s *JudgeSession, stage *Stage) error
+	// WaitReady blocks until the stage is producing protocol output
+	WaitReady(ctx context.Context, s *JudgeSession, stage *Stage) error
+	// Stream returns the protocol output of the stage, resuming after the
+	// output of the session already applied where it can
+	Stream(ctx context.Context, s *JudgeSession, stage *Stage) (io.ReadCloser, error)
+	// Finish blocks until the stage is over, and reports whether it succeeded
+	Finish(ctx context.Context, s *JudgeSession, stage *Stage) (bool, error)
+	// Monitor blocks until ctx is done, or returns a *statusError as soon as
+	// the stage fails in a way the judge can't report, e.g. out of memory
+	Monitor(ctx context.Context, s *JudgeSession, stage *Stage) error
+	// Teardown destroys everything created for the session
+	Teardown(ctx context.Context, s *JudgeSession) error
+}
+
+const (
+	ExecutorKubernetes = "kubernetes"
+	ExecutorLocal      = "local"
+)
+
+func (m *Manager) initExecutor() error {
+	switch *m.conf.Executor {
+	case ExecutorKubernetes, "":
+		// Templates are only used to create namespaces
+		tmpls, err := LoadTemplateSet(*m.conf.TemplatePath)
+		if err != nil {
+			return err
+		}
+		m.tmpls.Store(tmpls)
+		log.Println("Loaded", len(tmpls.Default), "namespace templates and", len(tmpls.Named), "template sets")
+
+		e, err := newKubeExecutor(m)
+		if err != nil {
+			return err
+		}
+		m.exec = e
+	case ExecutorLocal:
+		m.exec = newLocalExecutor(*m.conf.LocalCommand, *m.conf.LocalWorkDir)
+	default:
+		return fmt.Errorf("unknown executor: %s", *m.conf.Executor)
+	}
+	return nil
+}
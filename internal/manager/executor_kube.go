@@ -0,0 +1,498 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lcpu-club/hpcgame-judger/internal/kube"
+	"github.com/lcpu-club/hpcgame-judger/internal/utils"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// kubeExecutor runs every session in its own namespace, with the judge
+// running as a Job in it
+type kubeExecutor struct {
+	m  *Manager
+	kc *kube.Client
+}
+
+func newKubeExecutor(m *Manager) (*kubeExecutor, error) {
+	sm := utils.NewSecretManager(*m.conf.KubeSecretPath)
+	kc, err := kube.NewClient(*m.conf.Kubernetes, sm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kubeExecutor{
+		m:  m,
+		kc: kc,
+	}, nil
+}
+
+const namespaceTerminatingPollInterval = 2 * time.Second
+
+func (e *kubeExecutor) Provision(ctx context.Context, s *JudgeSession) error {
+	nsName := s.GetNamespaceName()
+
+	for {
+		ns, err := e.kc.Client().CoreV1().Namespaces().Get(ctx, nsName, metav1.GetOptions{})
+		if err != nil {
+			break
+		}
+		if ns.Status.Phase != corev1.NamespaceTerminating {
+			return nil
+		}
+
+		// Left over by a previous run of the same session, which is
+		// retried or requeued
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(namespaceTerminatingPollInterval):
+		}
+	}
+
+	err := e.createNamespace(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (e *kubeExecutor) createNamespace(ctx context.Context, s *JudgeSession) error {
+	nsName := s.GetNamespaceName()
+
+	docs, err := RenderNamespace(s.tmpls, s.rc, nsName, s.judgeContext())
+	if err != nil {
+		return err
+	}
+
+	// Nothing is created if any of the jobs would be rejected later
+	var jobs []*batchv1.Job
+	for _, stage := range s.rc.stages() {
+		job, err := BuildJob(nsName, stage, s.judgeContext(), e.problemDataVolume(s))
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, job)
+	}
+	err = s.checkPolicy(docs, jobs)
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		err = e.kc.Create(ctx, doc, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Applied, the default service account may be created in the meantime
+	sandbox, err := RenderSandbox(s.rc.Sandbox, nsName)
+	if err != nil {
+		return err
+	}
+	for _, doc := range sandbox {
+		err = e.kc.Apply(ctx, doc, false)
+		if err != nil {
+			return wrapError("sandbox", err)
+		}
+	}
+
+	log.Println("Created namespace", nsName)
+
+	return nil
+}
+
+const deleteNamespaceGracePeriods = 5
+
+func (e *kubeExecutor) Teardown(ctx context.Context, s *JudgeSession) error {
+	err := e.kc.DeleteNamespace(ctx, s.GetNamespaceName(), deleteNamespaceGracePeriods)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Deleted namespace", s.GetNamespaceName())
+
+	clusterRoleBindingName := s.GetNamespaceName() + clusterRoleBindingSuffix
+	err = e.kc.Client().RbacV1().
+		ClusterRoleBindings().Delete(ctx, clusterRoleBindingName, metav1.DeleteOptions{})
+	if client.IgnoreNotFound(err) != nil {
+		log.Println("Failed to delete cluster role binding:", err)
+	}
+
+	return nil
+}
+
+func (e *kubeExecutor) Start(ctx context.Context, s *JudgeSession, stage *Stage) error {
+	jobName := stage.Name
+
+	_, err := e.kc.Client().BatchV1().Jobs(s.GetNamespaceName()).Get(ctx, jobName, metav1.GetOptions{})
+	if err == nil {
+		return nil
+	}
+
+	err = e.createJob(ctx, s, stage)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Created job", s.GetNamespaceName(), jobName)
+
+	return nil
+}
+
+func (e *kubeExecutor) createJob(ctx context.Context, s *JudgeSession, stage *Stage) error {
+	job, err := BuildJob(s.GetNamespaceName(), stage, s.judgeContext(), e.problemDataVolume(s))
+	if err != nil {
+		return err
+	}
+
+	err = s.checkPolicy(nil, []*batchv1.Job{job})
+	if err != nil {
+		return err
+	}
+
+	_, err = e.kc.Client().BatchV1().Jobs(s.GetNamespaceName()).Create(ctx, job, metav1.CreateOptions{})
+	return err
+}
+
+// RenderNamespace returns the objects created in the namespace of a
+// session, the namespace itself is labeled and annotated with jc and the
+// Pod Security Standard of the sandbox
+func RenderNamespace(ts *TemplateSet, rc *RunningConfig, namespace string, jc *JudgeContext) ([]string, error) {
+	tmpls, err := ts.Select(rc.TemplateSet)
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := sandboxLabels(rc.Sandbox)
+	if err != nil {
+		return nil, err
+	}
+	labels = mergeMap(labels, jc.Labels())
+
+	docs, err := Render(tmpls, &TemplateValues{
+		Namespace: namespace,
+		Variables: rc.Variables,
+		Context:   jc,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, doc := range docs {
+		docs[i], err = labelNamespace(doc, namespace, labels, jc.Annotations())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+// labelNamespace adds the labels and annotations to the namespace if it's
+// in doc, other objects are kept as is
+func labelNamespace(doc string, namespace string, labels map[string]string, annotations map[string]string) (string, error) {
+	objs := kube.SplitDocuments(doc)
+
+	found := false
+	for i, obj := range objs {
+		u := &unstructured.Unstructured{}
+		err := yaml.Unmarshal([]byte(obj), &u.Object)
+		if err != nil || u.GetKind() != "Namespace" || u.GetName() != namespace {
+			continue
+		}
+
+		u.SetLabels(mergeMap(u.GetLabels(), labels))
+		u.SetAnnotations(mergeMap(u.GetAnnotations(), annotations))
+
+		b, err := yaml.Marshal(u.Object)
+		if err != nil {
+			return "", err
+		}
+		objs[i] = string(b)
+		found = true
+	}
+
+	if !found {
+		return doc, nil
+	}
+	return strings.Join(objs, "\n---\n"), nil
+}
+
+// problemDataVolume returns where the session mounts the cached problem
+// data from, nil if it's not cached
+func (e *kubeExecutor) problemDataVolume(s *JudgeSession) *ProblemDataVolume {
+	claim := *e.m.conf.ProblemDataClaim
+	if s.problemData == "" || claim == "" {
+		return nil
+	}
+
+	rel, err := filepath.Rel(*e.m.conf.SharedVolumePath, s.problemData)
+	if err != nil {
+		log.Println("Failed to locate problem data:", err)
+		return nil
+	}
+
+	return &ProblemDataVolume{
+		ClaimName: claim,
+		SubPath:   rel,
+	}
+}
+
+// BuildJob returns the job of the stage as it's submitted, data is nil if
+// the problem data isn't mounted
+func BuildJob(namespace string, stage *Stage, jc *JudgeContext, data *ProblemDataVolume) (*batchv1.Job, error) {
+	if stage.JobTemplate == nil {
+		return nil, fmt.Errorf("job template of stage %s is nil", stage.Name)
+	}
+
+	job, err := applyOverrides(stage.JobTemplate, stage.overrides, jc)
+	if err != nil {
+		return nil, err
+	}
+	job.Namespace = namespace
+	job.Name = stage.Name
+
+	labels := jc.Labels()
+	job.Labels = mergeMap(job.Labels, labels)
+	job.Annotations = mergeMap(job.Annotations, jc.Annotations())
+	job.Spec.Template.Labels = mergeMap(job.Spec.Template.Labels, labels)
+	job.Spec.Template.Labels[roleLabel] = roleJudge
+
+	env, err := jc.Env()
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &job.Spec.Template.Spec
+	for k := range spec.InitContainers {
+		spec.InitContainers[k].Env = setEnv(spec.InitContainers[k].Env, env...)
+	}
+	for k := range spec.Containers {
+		spec.Containers[k].Env = setEnv(spec.Containers[k].Env, env...)
+	}
+
+	if data != nil {
+		mountProblemData(spec, data)
+	}
+
+	if stage.QueueName != "" {
+		queueJob(job, stage.QueueName)
+	}
+
+	return job, nil
+}
+
+// mountProblemData mounts the cached problem data read-only into every
+// container and init container of the pod
+func mountProblemData(spec *corev1.PodSpec, data *ProblemDataVolume) {
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name: problemDataVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: data.ClaimName,
+				ReadOnly:  true,
+			},
+		},
+	})
+
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for k := range containers {
+			c := &containers[k]
+			c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{
+				Name:      problemDataVolumeName,
+				MountPath: problemDataMountPath,
+				SubPath:   data.SubPath,
+				ReadOnly:  true,
+			})
+			c.Env = setEnv(c.Env, corev1.EnvVar{
+				Name:  "PROBLEM_DATA_PATH",
+				Value: filepath.Join(problemDataMountPath, problemDataFile),
+			})
+		}
+	}
+}
+
+func (e *kubeExecutor) Stream(ctx context.Context, s *JudgeSession, stage *Stage) (io.ReadCloser, error) {
+	return &jobLogReader{
+		ctx:   ctx,
+		e:     e,
+		s:     s,
+		stage: stage,
+	}, nil
+}
+
+func calcReadyAndFinishedPods(job batchv1.JobStatus) int {
+	ready := 0
+	if job.Ready != nil {
+		ready = int(*job.Ready)
+	}
+	// active := int(job.Active)
+	finished := int(job.Succeeded + job.Failed)
+	terminating := 0
+	if job.Terminating != nil {
+		terminating = int(*job.Terminating)
+	}
+	return ready + finished + terminating
+}
+
+func (e *kubeExecutor) WaitReady(ctx context.Context, s *JudgeSession, stage *Stage) error {
+	jobName := stage.Name
+	jobs := e.kc.Client().BatchV1().Jobs(s.GetNamespaceName())
+
+	watcher, err := jobs.Watch(ctx, metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("metadata.name=%s", jobName),
+	})
+	if err != nil {
+		return err
+	}
+	defer watcher.Stop()
+
+	// Check for status, in case it's already running
+	job, err := jobs.Get(ctx, jobName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if job.Status.Active > 0 {
+		if job.Status.Ready != nil && *job.Status.Ready > 0 {
+			return nil
+		}
+	}
+	if job.Status.Succeeded > 0 || job.Status.Failed > 0 {
+		return nil
+	}
+	if calcReadyAndFinishedPods(job.Status) > 0 {
+		return nil
+	}
+	log.Println("Job not ready yet", s.GetNamespaceName())
+
+	// A queued job stays suspended until Kueue admits it
+	ticker := time.NewTicker(admissionPollInterval)
+	defer ticker.Stop()
+	err = e.checkAdmission(ctx, s, job)
+	if err != nil {
+		return err
+	}
+
+	// Wait for the job to start running
+	for {
+		select {
+		case <-ticker.C:
+			job, err := jobs.Get(ctx, jobName, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			err = e.checkAdmission(ctx, s, job)
+			if err != nil {
+				return err
+			}
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return errWatchClosed
+			}
+
+			job, ok := event.Object.(*batchv1.Job)
+			if !ok {
+				continue
+			}
+
+			// Resumed by Kueue
+			if !ptr.Deref(job.Spec.Suspend, false) {
+				s.setQueued(false, "")
+			}
+
+			// Check if the job has started running
+			if job.Status.Active > 0 {
+				if job.Status.Ready != nil && *job.Status.Ready > 0 {
+					return nil
+				}
+			}
+			if job.Status.Succeeded > 0 || job.Status.Failed > 0 {
+				return nil
+			}
+
+			if event.Type != watch.Added && event.Type != watch.Modified {
+				return fmt.Errorf("job not running: %s", job.Status.String())
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// jobFinished reports whether the job is over, and whether it succeeded
+func jobFinished(job *batchv1.Job) (bool, bool) {
+	for _, c := range job.Status.Conditions {
+		if c.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch c.Type {
+		case batchv1.JobComplete:
+			return true, true
+		case batchv1.JobFailed:
+			return true, false
+		}
+	}
+	return false, false
+}
+
+func (e *kubeExecutor) Finish(ctx context.Context, s *JudgeSession, stage *Stage) (bool, error) {
+	jobName := stage.Name
+	jobs := e.kc.Client().BatchV1().Jobs(s.GetNamespaceName())
+
+	watcher, err := jobs.Watch(ctx, metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("metadata.name=%s", jobName),
+	})
+	if err != nil {
+		return false, err
+	}
+	defer watcher.Stop()
+
+	// The output may end a bit before the job is marked as finished
+	job, err := jobs.Get(ctx, jobName, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	if done, ok := jobFinished(job); done {
+		return ok, nil
+	}
+
+	for {
+		select {
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return false, errWatchClosed
+			}
+
+			job, ok := event.Object.(*batchv1.Job)
+			if !ok {
+				continue
+			}
+
+			if done, ok := jobFinished(job); done {
+				return ok, nil
+			}
+
+			if event.Type != watch.Added && event.Type != watch.Modified {
+				return false, fmt.Errorf("job not running: %s", job.Status.String())
+			}
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lcpu-club/hpcgame-judger/pkg/aoiclient"
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/utils/ptr"
+)
+
+// Jobs with a queue name are admitted by Kueue: they are created suspended,
+// and a Workload created for them waits for quota until Kueue resumes them.
+const (
+	kueueQueueNameLabel = "kueue.x-k8s.io/queue-name"
+	kueueJobUIDLabel    = "kueue.x-k8s.io/job-uid"
+)
+
+var workloadResource = schema.GroupVersionResource{
+	Group:    "kueue.x-k8s.io",
+	Version:  "v1beta1",
+	Resource: "workloads",
+}
+
+// queueJob submits the job to the Kueue queue
+func queueJob(job *batchv1.Job, queue string) {
+	if job.Labels == nil {
+		job.Labels = make(map[string]string)
+	}
+	job.Labels[kueueQueueNameLabel] = queue
+	job.Spec.Suspend = ptr.To(true)
+}
+
+type admission int
+
+const (
+	admissionAdmitted admission = iota
+	admissionPending
+	admissionRejected
+)
+
+// workloadOf returns the Workload of the job, nil if it's not created yet
+func (e *kubeExecutor) workloadOf(ctx context.Context, job *batchv1.Job) (*unstructured.Unstructured, error) {
+	list, err := e.kc.Dynamic().Resource(workloadResource).Namespace(job.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", kueueJobUIDLabel, job.UID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Items) == 0 {
+		return nil, nil
+	}
+	return &list.Items[0], nil
+}
+
+// workloadCondition returns the status, reason and message of a condition
+func workloadCondition(wl *unstructured.Unstructured, condType string) (string, string, string) {
+	conds, _, _ := unstructured.NestedSlice(wl.Object, "status", "conditions")
+	for _, c := range conds {
+		cond, ok := c.(map[string]interface{})
+		if !ok || cond["type"] != condType {
+			continue
+		}
+		status, _ := cond["status"].(string)
+		reason, _ := cond["reason"].(string)
+		message, _ := cond["message"].(string)
+		return status, reason, message
+	}
+	return "", "", ""
+}
+
+// admissionOf tells whether a suspended job is waiting in its queue or was
+// rejected by Kueue, along with the reason. An inadmissible workload, e.g.
+// one asking for more than the quota right now, keeps waiting as it may be
+// admitted once the queue or the quota changes.
+func (e *kubeExecutor) admissionOf(ctx context.Context, job *batchv1.Job) (admission, string, error) {
+	if !ptr.Deref(job.Spec.Suspend, false) {
+		return admissionAdmitted, "", nil
+	}
+
+	wl, err := e.workloadOf(ctx, job)
+	if err != nil {
+		return admissionPending, "", err
+	}
+	if wl == nil {
+		return admissionPending, "Waiting for the workload to be created", nil
+	}
+
+	// Deactivated, e.g. an admission check rejected it
+	if active, ok, _ := unstructured.NestedBool(wl.Object, "spec", "active"); ok && !active {
+		_, _, msg := workloadCondition(wl, "Evicted")
+		return admissionRejected, "Workload is deactivated: " + msg, nil
+	}
+	if status, _, msg := workloadCondition(wl, "Finished"); status == "True" {
+		return admissionRejected, "Workload finished before admission: " + msg, nil
+	}
+	// Requeued by Kueue, e.g. when preempted or not ready in time
+	if status, reason, msg := workloadCondition(wl, "Evicted"); status == "True" {
+		return admissionPending, fmt.Sprintf("Workload is evicted (%s): %s", reason, msg), nil
+	}
+
+	_, _, msg := workloadCondition(wl, "QuotaReserved")
+	if msg == "" {
+		msg = "Waiting for quota"
+	}
+	return admissionPending, msg, nil
+}
+
+const admissionPollInterval = 10 * time.Second
+
+// checkAdmission pauses the session while the job waits in its queue, it
+// fails the session if the job is rejected
+func (e *kubeExecutor) checkAdmission(ctx context.Context, s *JudgeSession, job *batchv1.Job) error {
+	adm, reason, err := e.admissionOf(ctx, job)
+	if err != nil {
+		log.Println("Failed to check admission:", err)
+		return nil
+	}
+
+	switch adm {
+	case admissionRejected:
+		s.setQueued(false, "")
+		return newStatusError(aoiclient.StatusError, "Judge job is rejected: %s", reason)
+	case admissionPending:
+		s.setQueued(true, reason)
+	default:
+		s.setQueued(false, "")
+	}
+	return nil
+}
@@ -0,0 +1,390 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/lcpu-club/hpcgame-judger/pkg/aoiclient"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	podCheckInterval = 5 * time.Second
+	// Pods may wait for capacity for a while before being scheduled
+	unschedulableTimeout = 5 * time.Minute
+)
+
+// Waiting reasons of a container which won't start by itself
+var containerStartFailures = map[string]bool{
+	"ImagePullBackOff":           true,
+	"ErrImageNeverPull":          true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+	"RunContainerError":          true,
+}
+
+// Selects the judge container of a pod with more than one container,
+// unless the stage names it
+const judgeContainerAnnotation = "hpcgame.pku.edu.cn/judge-container"
+
+// judgeContainerOf returns the name of the container speaking the protocol
+func judgeContainerOf(pod *corev1.Pod, stage *Stage) string {
+	if stage.Container != "" {
+		return stage.Container
+	}
+	if c := pod.Annotations[judgeContainerAnnotation]; c != "" {
+		return c
+	}
+	if c := pod.Annotations["kubectl.kubernetes.io/default-container"]; c != "" {
+		return c
+	}
+	return pod.Spec.Containers[0].Name
+}
+
+func containerStatusOf(pod *corev1.Pod, name string) *corev1.ContainerStatus {
+	for i := range pod.Status.ContainerStatuses {
+		if pod.Status.ContainerStatuses[i].Name == name {
+			return &pod.Status.ContainerStatuses[i]
+		}
+	}
+	return nil
+}
+
+// activePodOf returns the pod the job is currently running, which is the
+// newest running one, or the newest one if none is running
+func activePodOf(pods []corev1.Pod) *corev1.Pod {
+	var active *corev1.Pod
+	for i := range pods {
+		pod := &pods[i]
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+
+		if active == nil {
+			active = pod
+			continue
+		}
+
+		running, activeRunning := pod.Status.Phase == corev1.PodRunning, active.Status.Phase == corev1.PodRunning
+		if running != activeRunning {
+			if running {
+				active = pod
+			}
+			continue
+		}
+		if pod.CreationTimestamp.After(active.CreationTimestamp.Time) {
+			active = pod
+		}
+	}
+	return active
+}
+
+func (e *kubeExecutor) listPods(ctx context.Context, s *JudgeSession, stage *Stage) ([]corev1.Pod, error) {
+	pods, err := e.kc.Client().CoreV1().Pods(s.GetNamespaceName()).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("job-name=%s", stage.Name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+// classifyPod returns the failure of the judge pod, or nil if it's fine.
+// An eviction is only a failure if the job won't replace the pod.
+func classifyPod(pod *corev1.Pod, retriesLeft bool, now time.Time) *statusError {
+	if pod.Status.Reason == "Evicted" && !retriesLeft {
+		return newStatusError(aoiclient.StatusInternalError,
+			"Judge pod %s was evicted: %s", pod.Name, pod.Status.Message)
+	}
+
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodScheduled && c.Status == corev1.ConditionFalse &&
+			c.Reason == corev1.PodReasonUnschedulable &&
+			now.Sub(c.LastTransitionTime.Time) > unschedulableTimeout {
+			return newStatusError(aoiclient.StatusInternalError,
+				"Judge pod %s could not be scheduled for %s: %s", pod.Name, unschedulableTimeout, c.Message)
+		}
+	}
+
+	var statuses []corev1.ContainerStatus
+	statuses = append(statuses, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	for _, cs := range statuses {
+		for _, t := range []*corev1.ContainerStateTerminated{cs.State.Terminated, cs.LastTerminationState.Terminated} {
+			if t != nil && t.Reason == "OOMKilled" {
+				return newStatusError(aoiclient.StatusMemoryLimitExceeded,
+					"Container %s of judge pod %s ran out of memory", cs.Name, pod.Name)
+			}
+		}
+
+		w := cs.State.Waiting
+		if w == nil {
+			continue
+		}
+
+		if w.Reason == "CrashLoopBackOff" {
+			msg := fmt.Sprintf("Container %s of judge pod %s keeps crashing", cs.Name, pod.Name)
+			if t := cs.LastTerminationState.Terminated; t != nil {
+				msg += fmt.Sprintf(", last exited with code %d (%s)", t.ExitCode, t.Reason)
+			}
+			return newStatusError(aoiclient.StatusInternalError, "%s", msg)
+		}
+
+		if containerStartFailures[w.Reason] {
+			return newStatusError(aoiclient.StatusInternalError,
+				"Container %s of judge pod %s failed to start: %s: %s", cs.Name, pod.Name, w.Reason, w.Message)
+		}
+	}
+
+	return nil
+}
+
+// lastWarningOf returns the latest warning event of the pod, if any
+func (e *kubeExecutor) lastWarningOf(ctx context.Context, pod *corev1.Pod) *corev1.Event {
+	events, err := e.kc.Client().CoreV1().Events(pod.Namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("involvedObject.kind=Pod,involvedObject.name=%s,type=%s", pod.Name, corev1.EventTypeWarning),
+	})
+	if err != nil {
+		log.Println("Failed to list events:", err)
+		return nil
+	}
+
+	var last *corev1.Event
+	for i := range events.Items {
+		ev := &events.Items[i]
+		if last == nil || eventTime(ev).After(eventTime(last)) {
+			last = ev
+		}
+	}
+	return last
+}
+
+func eventTime(ev *corev1.Event) time.Time {
+	if !ev.LastTimestamp.IsZero() {
+		return ev.LastTimestamp.Time
+	}
+	return ev.EventTime.Time
+}
+
+func (e *kubeExecutor) Monitor(ctx context.Context, s *JudgeSession, stage *Stage) error {
+	ticker := time.NewTicker(podCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		job, err := e.kc.Client().BatchV1().Jobs(s.GetNamespaceName()).Get(ctx, stage.Name, metav1.GetOptions{})
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("Failed to get job:", err)
+			}
+			continue
+		}
+
+		pods, err := e.listPods(ctx, s, stage)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("Failed to list pods:", err)
+			}
+			continue
+		}
+
+		// Failed pods replaced by the job are not interesting
+		pod := activePodOf(pods)
+		if pod == nil {
+			continue
+		}
+
+		retriesLeft := job.Spec.BackoffLimit != nil && job.Status.Failed <= *job.Spec.BackoffLimit
+		if done, _ := jobFinished(job); done {
+			retriesLeft = false
+		}
+
+		se := classifyPod(pod, retriesLeft, time.Now())
+		if se == nil {
+			continue
+		}
+
+		if ev := e.lastWarningOf(ctx, pod); ev != nil {
+			se.msg += fmt.Sprintf(" (last event: %s: %s)", ev.Reason, ev.Message)
+		}
+		log.Println("Judge pod failed", s.GetNamespaceName(), ":", se.msg)
+		return se
+	}
+}
+
+// jobLogReader reads the output of the judge container of the active pod
+// of the job, until the job is over. When the pod is replaced or the
+// container is restarted, it reads the new container from the start. When
+// the connection drops or the manager restarts, it resumes the container
+// from the output already applied.
+type jobLogReader struct {
+	ctx   context.Context
+	e     *kubeExecutor
+	s     *JudgeSession
+	stage *Stage
+
+	cur io.ReadCloser
+	// Container instance read by cur, or read to the end
+	podUID   types.UID
+	restarts int32
+	opened   bool
+}
+
+func (r *jobLogReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			err := r.open()
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := r.cur.Read(p)
+		if n > 0 || err == nil {
+			return n, nil
+		}
+
+		r.cur.Close()
+		r.cur = nil
+		if r.ctx.Err() != nil {
+			return 0, r.ctx.Err()
+		}
+		if err != io.EOF {
+			log.Println("Judge output interrupted", r.s.GetNamespaceName(), ":", err)
+		}
+	}
+}
+
+func containerInstance(podUID types.UID, restarts int32) string {
+	return fmt.Sprintf("%s/%d", podUID, restarts)
+}
+
+// Instance returns the container instance of the output read last
+func (r *jobLogReader) Instance() string {
+	return containerInstance(r.podUID, r.restarts)
+}
+
+func (r *jobLogReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
+
+// open waits for a container to read from, it returns io.EOF once the job
+// is over and its output is read
+func (r *jobLogReader) open() error {
+	ns := r.s.GetNamespaceName()
+
+	for {
+		ok, err := r.tryOpen()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		case <-time.After(podCheckInterval):
+		}
+		log.Println("Waiting for judge output", ns, r.stage.Name)
+	}
+}
+
+func (r *jobLogReader) tryOpen() (bool, error) {
+	ctx := r.ctx
+
+	// The namespace is torn down once the judge quits
+	if r.s.quit {
+		return false, io.EOF
+	}
+
+	job, err := r.e.kc.Client().BatchV1().Jobs(r.s.GetNamespaceName()).Get(ctx, r.stage.Name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	done, _ := jobFinished(job)
+	if done && r.opened {
+		return false, io.EOF
+	}
+
+	pods, err := r.e.listPods(ctx, r.s, r.stage)
+	if err != nil {
+		return false, err
+	}
+
+	// Nothing left to read of a finished job
+	pod := activePodOf(pods)
+	if pod == nil {
+		if done {
+			return false, io.EOF
+		}
+		return false, nil
+	}
+	container := judgeContainerOf(pod, r.stage)
+	cs := containerStatusOf(pod, container)
+	if cs == nil {
+		if done {
+			return false, io.EOF
+		}
+		return false, nil
+	}
+
+	readBefore := r.opened && pod.UID == r.podUID && cs.RestartCount == r.restarts
+	if t := cs.State.Terminated; t != nil && readBefore {
+		// Done if it's not going to be restarted, otherwise wait for the
+		// job to restart it or give up
+		if t.ExitCode == 0 {
+			return false, io.EOF
+		}
+		return false, nil
+	}
+	if cs.State.Running == nil && cs.State.Terminated == nil {
+		return false, nil
+	}
+
+	// Only the instance the output was applied of can be resumed, and only
+	// if its messages can't be skipped by seq
+	since, err := r.s.resumePoint(containerInstance(pod.UID, cs.RestartCount))
+	if err != nil {
+		return false, err
+	}
+	if since != nil {
+		log.Println("Resuming judge output", r.s.GetNamespaceName(), "from pod", pod.Name, "container", container)
+	} else if r.opened {
+		log.Println("Reading judge output", r.s.GetNamespaceName(), "from the start of pod", pod.Name, "container", container)
+	}
+
+	opts := &corev1.PodLogOptions{
+		Container: container,
+		Follow:    true,
+	}
+	if since != nil {
+		opts.SinceTime = &metav1.Time{Time: *since}
+	}
+	reader, err := r.e.kc.Client().CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, opts).Stream(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	r.cur = reader
+	r.podUID = pod.UID
+	r.restarts = cs.RestartCount
+	r.opened = true
+
+	return true, nil
+}
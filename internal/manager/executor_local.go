@@ -0,0 +1,223 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// localExecutor runs the judge binary as a child process of the manager,
+// which makes it possible to run the whole pipeline without Kubernetes.
+// Every stage runs the same command, with the stage name in JUDGE_STAGE.
+type localExecutor struct {
+	command []string
+	workDir string
+
+	procs map[string]*localProcess
+	lock  *sync.Mutex
+}
+
+type localProcess struct {
+	dir string
+
+	stage  string
+	cmd    *exec.Cmd
+	stdout *os.File
+	// Closed once the process is reaped
+	done chan struct{}
+}
+
+func newLocalExecutor(command string, workDir string) *localExecutor {
+	return &localExecutor{
+		command: strings.Fields(command),
+		workDir: workDir,
+
+		procs: make(map[string]*localProcess),
+		lock:  &sync.Mutex{},
+	}
+}
+
+func (e *localExecutor) Provision(ctx context.Context, s *JudgeSession) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if _, ok := e.procs[s.id]; ok {
+		return nil
+	}
+
+	dir, err := os.MkdirTemp(e.workDir, s.GetNamespaceName()+"-")
+	if err != nil {
+		return err
+	}
+	e.procs[s.id] = &localProcess{dir: dir}
+
+	log.Println("Created work directory", dir)
+
+	return nil
+}
+
+func (e *localExecutor) Start(ctx context.Context, s *JudgeSession, stage *Stage) error {
+	if len(e.command) == 0 {
+		return errors.New("local judge command is empty")
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	p, ok := e.procs[s.id]
+	if !ok {
+		return errors.New("session is not provisioned")
+	}
+	if p.cmd != nil {
+		if p.stage == stage.Name {
+			return nil
+		}
+		// Done with the previous stage
+		p.kill()
+	}
+
+	// Not bound to ctx, the process is killed in Teardown
+	cmd := exec.Command(e.command[0], e.command[1:]...)
+	cmd.Dir = p.dir
+	env, err := s.judgeContext().Env()
+	if err != nil {
+		return err
+	}
+	cmd.Env = os.Environ()
+	for _, v := range env {
+		cmd.Env = append(cmd.Env, v.Name+"="+v.Value)
+	}
+	cmd.Env = append(cmd.Env, "JUDGE_STAGE="+stage.Name)
+	if s.problemData != "" {
+		cmd.Env = append(cmd.Env, "PROBLEM_DATA_PATH="+filepath.Join(s.problemData, problemDataFile))
+	}
+	cmd.Stderr = os.Stderr
+
+	// Use our own pipe instead of StdoutPipe, so that reaping the process
+	// doesn't close the reader under a running Stream
+	stdout, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = w
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		stdout.Close()
+		return err
+	}
+	p.stage = stage.Name
+	p.cmd = cmd
+	p.stdout = stdout
+	p.done = make(chan struct{})
+	go func(done chan struct{}) {
+		// Release the process resources, the exit status is read in Finish
+		cmd.Wait()
+		close(done)
+	}(p.done)
+
+	log.Println("Started local judge", s.GetNamespaceName(), stage.Name, "with pid", cmd.Process.Pid)
+
+	return nil
+}
+
+// kill kills the process and waits for it to be reaped
+func (p *localProcess) kill() {
+	p.cmd.Process.Kill()
+	<-p.done
+
+	if p.stdout != nil {
+		p.stdout.Close()
+		p.stdout = nil
+	}
+}
+
+func (e *localExecutor) WaitReady(ctx context.Context, s *JudgeSession, stage *Stage) error {
+	// A started process is always ready to produce output
+	return nil
+}
+
+func (e *localExecutor) Stream(ctx context.Context, s *JudgeSession, stage *Stage) (io.ReadCloser, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	p, ok := e.procs[s.id]
+	if !ok || p.stage != stage.Name || p.stdout == nil {
+		return nil, errors.New("local judge is not started")
+	}
+
+	// The pipe can only be consumed once, output is never replayed
+	stdout := p.stdout
+	p.stdout = nil
+
+	return &localStream{
+		File:     stdout,
+		instance: fmt.Sprintf("%s/%d", s.m.ID(), p.cmd.Process.Pid),
+	}, nil
+}
+
+// localStream is the output of a judge process
+type localStream struct {
+	*os.File
+	instance string
+}
+
+func (s *localStream) Instance() string {
+	return s.instance
+}
+
+func (e *localExecutor) Finish(ctx context.Context, s *JudgeSession, stage *Stage) (bool, error) {
+	e.lock.Lock()
+	p, ok := e.procs[s.id]
+	if !ok || p.stage != stage.Name || p.cmd == nil {
+		e.lock.Unlock()
+		return false, errors.New("local judge is not started")
+	}
+	cmd, done := p.cmd, p.done
+	e.lock.Unlock()
+
+	select {
+	case <-done:
+		return cmd.ProcessState.Success(), nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+func (e *localExecutor) Monitor(ctx context.Context, s *JudgeSession, stage *Stage) error {
+	// A crashed process shows up in Finish
+	<-ctx.Done()
+	return nil
+}
+
+func (e *localExecutor) Teardown(ctx context.Context, s *JudgeSession) error {
+	e.lock.Lock()
+	p, ok := e.procs[s.id]
+	delete(e.procs, s.id)
+	e.lock.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	if p.cmd != nil {
+		p.kill()
+	}
+
+	err := os.RemoveAll(p.dir)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Removed work directory", p.dir)
+
+	return nil
+}
@@ -0,0 +1,235 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/lcpu-club/hpcgame-judger/internal/config"
+	"github.com/lcpu-club/hpcgame-judger/internal/policy"
+	"github.com/lcpu-club/hpcgame-judger/pkg/aoiclient"
+)
+
+// fakeAOI records the calls of the runner API
+type fakeAOI struct {
+	*httptest.Server
+
+	lock    *sync.Mutex
+	calls   []string
+	patches []*aoiclient.SolutionInfo
+	details []*aoiclient.SolutionDetails
+}
+
+func newFakeAOI(t *testing.T) *fakeAOI {
+	f := &fakeAOI{lock: &sync.Mutex{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		f.calls = append(f.calls, r.Method+" "+r.URL.Path)
+		body, _ := io.ReadAll(r.Body)
+
+		switch {
+		case r.Method == http.MethodPatch:
+			info := new(aoiclient.SolutionInfo)
+			json.Unmarshal(body, info)
+			f.patches = append(f.patches, info)
+		case strings.HasSuffix(r.URL.Path, "/details/upload"):
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"url": f.URL + "/upload"})
+			return
+		case r.URL.Path == "/upload":
+			details := new(aoiclient.SolutionDetails)
+			json.Unmarshal(body, details)
+			f.details = append(f.details, details)
+		}
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// count returns the number of calls ending with suffix
+func (f *fakeAOI) count(suffix string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	n := 0
+	for _, c := range f.calls {
+		if strings.HasSuffix(c, suffix) {
+			n++
+		}
+	}
+	return n
+}
+
+// newLocalTestManager sets up a manager like Init does, with the local
+// executor running script and everything else faked
+func newLocalTestManager(t *testing.T, script string) (*Manager, *fakeAOI) {
+	dir := t.TempDir()
+	judge := filepath.Join(dir, "judge.sh")
+	err := os.WriteFile(judge, []byte("#!/bin/sh\n"+script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mr := miniredis.RunT(t)
+	aoi := newFakeAOI(t)
+
+	conf := &config.ManagerConfig{
+		Endpoint:         &aoi.URL,
+		RedisConfig:      ptrTo("redis://" + mr.Addr()),
+		SharedVolumePath: ptrTo(filepath.Join(dir, "shared")),
+		PoolLimits:       ptrTo(""),
+		MaxAttempts:      ptrTo[int64](1),
+		RetryBackoff:     ptrTo(time.Millisecond),
+		DrainTimeout:     ptrTo(time.Second),
+		LocalCommand:     ptrTo("/bin/sh " + judge),
+		LocalWorkDir:     ptrTo(dir),
+	}
+	m := NewManager(conf)
+	m.exec = newLocalExecutor(*conf.LocalCommand, *conf.LocalWorkDir)
+	m.aoi = aoiclient.New(aoi.URL).Authenticate("runner", "key")
+	m.r, err = NewRedis(*conf.RedisConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.genID()
+	m.q = NewAdmissionQueue(m.r, "queue", m.poolNameOf)
+	m.rl = NewRateLimiter(m.r, "ratelimit:leases", "ratelimit:total", m.managerID)
+	err = m.rl.Init(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.policy = policy.Default()
+	err = m.initPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m, aoi
+}
+
+func ptrTo[T any](v T) *T {
+	return &v
+}
+
+// judgeAndWait admits soln, dispatches it and waits for the session to end
+func judgeAndWait(t *testing.T, m *Manager, soln *aoiclient.SolutionPoll) {
+	err := m.solnAdmission(soln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.dispatch(make(map[string]bool)) {
+		t.Fatal("solution is not dispatched")
+	}
+	if !waitTimeout(m.runs, 10*time.Second) {
+		t.Fatal("session is not finished")
+	}
+}
+
+// assertCleanedUp checks that nothing of the session is left but its logs
+func assertCleanedUp(t *testing.T, m *Manager, id string) {
+	keys, err := m.r.Keys(context.TODO(), "*").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if strings.Contains(key, id) && key != logStreamKey(id) {
+			t.Errorf("%s is left", key)
+		}
+	}
+
+	n, err := m.q.Len()
+	if err != nil || n != 0 {
+		t.Errorf("queue length is %d, %v", n, err)
+	}
+	n, err = m.rl.Current()
+	if err != nil || n != 0 {
+		t.Errorf("rate limit tokens in use are %d, %v", n, err)
+	}
+}
+
+func TestLocalExecutorJudgesSolution(t *testing.T) {
+	m, aoi := newLocalTestManager(t, `
+echo '{"t":"2026-01-01T00:00:00Z","s":1,"a":"l","b":"judging '"$JUDGE_STAGE"'"}'
+echo '{"t":"2026-01-01T00:00:00Z","s":2,"a":"p","b":{"score":100,"status":"Accepted","message":"ok"}}'
+echo '{"t":"2026-01-01T00:00:00Z","s":3,"a":"d","b":{"version":1,"summary":"all passed"}}'
+echo '{"t":"2026-01-01T00:00:00Z","s":4,"a":"c"}'
+echo '{"t":"2026-01-01T00:00:00Z","s":5,"a":"q"}'
+`)
+	soln := &aoiclient.SolutionPoll{
+		SolutionId: "s1",
+		TaskId:     "t1",
+		ContestId:  "contest",
+		UserId:     "user",
+		ProblemConfig: aoiclient.ProblemConfig{
+			Judge: aoiclient.ProblemConfigJudge{Config: json.RawMessage(`{}`)},
+		},
+	}
+	id := solutionPollID(soln)
+
+	judgeAndWait(t, m, soln)
+
+	if len(aoi.patches) != 1 || aoi.patches[0].Score != 100 || aoi.patches[0].Status != "Accepted" {
+		t.Errorf("patched %+v, want a score of 100", aoi.patches)
+	}
+	if len(aoi.details) != 1 || aoi.details[0].Summary != "all passed" {
+		t.Errorf("saved details %+v", aoi.details)
+	}
+	// Completed by the judge, not again after the last stage
+	if n := aoi.count("/api/runner/solution/task/s1/t1/complete"); n != 1 {
+		t.Errorf("completed %d times, want once", n)
+	}
+
+	logs, err := os.ReadFile(m.logArchivePath(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(logs), "judging judge") {
+		t.Errorf("archived logs are %q", logs)
+	}
+
+	assertCleanedUp(t, m, id)
+}
+
+func TestLocalExecutorFailsInvalidConfig(t *testing.T) {
+	m, aoi := newLocalTestManager(t, `
+echo '{"t":"2026-01-01T00:00:00Z","s":1,"a":"c"}'
+`)
+	soln := &aoiclient.SolutionPoll{
+		SolutionId: "s2",
+		TaskId:     "t2",
+		ContestId:  "contest",
+		UserId:     "user",
+		ProblemConfig: aoiclient.ProblemConfig{
+			Judge: aoiclient.ProblemConfigJudge{Config: json.RawMessage(`{"deadline":"forever"}`)},
+		},
+	}
+
+	judgeAndWait(t, m, soln)
+
+	var statuses []string
+	for _, p := range aoi.patches {
+		statuses = append(statuses, p.Status)
+	}
+	if !slices.Equal(statuses, []string{aoiclient.StatusError}) ||
+		!strings.Contains(aoi.patches[0].Message, "Invalid judge config") {
+		t.Errorf("patched %+v, want an invalid config error", aoi.patches)
+	}
+	if n := aoi.count("/api/runner/solution/task/s2/t2/complete"); n != 1 {
+		t.Errorf("completed %d times, want once", n)
+	}
+
+	assertCleanedUp(t, m, solutionPollID(soln))
+}
@@ -0,0 +1,180 @@
+package manager
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	judgeNamespaceSelector   = "hpcgame.pku.edu.cn/kind=judge"
+	clusterRoleBindingSuffix = "-judge-binding"
+	maxGCLoggedObjects       = 16
+)
+
+// gcReport is what a garbage collection pass cleaned up
+type gcReport struct {
+	Time                time.Time `json:"time"`
+	Namespaces          []string  `json:"namespaces"`
+	ClusterRoleBindings []string  `json:"clusterRoleBindings"`
+	Errors              []string  `json:"errors,omitempty"`
+}
+
+// activeTaskIDs returns the tasks of the sessions which are admitted or
+// locked, their namespaces must be kept
+func (m *Manager) activeTaskIDs() (map[string]bool, error) {
+	ids, err := m.r.ListSolutionPoll()
+	if err != nil {
+		return nil, err
+	}
+
+	locks, err := m.r.List(judgeSessionLockKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// IDs end with the task ID: soln:<solution>:<task>
+	tasks := make(map[string]bool)
+	for _, id := range append(ids, locks...) {
+		i := strings.LastIndex(id, ":")
+		tasks[id[i+1:]] = true
+	}
+	return tasks, nil
+}
+
+// isOrphan reports whether the object of the namespace ns is left over by
+// a session which is gone, and old enough to not be one just admitted
+func isOrphan(ns string, created metav1.Time, active map[string]bool, grace time.Duration) bool {
+	taskID, ok := strings.CutPrefix(ns, nsPrefix)
+	if !ok || active[taskID] {
+		return false
+	}
+	return time.Since(created.Time) > grace
+}
+
+// collectGarbage deletes the judge namespaces and cluster role bindings
+// left over by sessions which no longer exist, e.g. when a manager crashed
+// before tearing them down
+func (m *Manager) collectGarbage(ctx context.Context, e *kubeExecutor) (*gcReport, error) {
+	report := &gcReport{Time: time.Now()}
+	grace := *m.conf.GCGracePeriod
+
+	// Listed before the sessions, so a namespace created in between is
+	// never seen without its session
+	nsList, err := e.kc.Client().CoreV1().Namespaces().List(ctx, metav1.ListOptions{
+		LabelSelector: judgeNamespaceSelector,
+	})
+	if err != nil {
+		return nil, err
+	}
+	crbList, err := e.kc.Client().RbacV1().ClusterRoleBindings().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	active, err := m.activeTaskIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces := make(map[string]bool)
+	for _, ns := range nsList.Items {
+		namespaces[ns.Name] = true
+
+		if ns.Status.Phase == corev1.NamespaceTerminating {
+			continue
+		}
+		if !isOrphan(ns.Name, ns.CreationTimestamp, active, grace) {
+			continue
+		}
+
+		err := e.kc.DeleteNamespace(ctx, ns.Name, deleteNamespaceGracePeriods)
+		if client.IgnoreNotFound(err) != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		report.Namespaces = append(report.Namespaces, ns.Name)
+		metricGCDeleted.WithLabelValues("namespace").Inc()
+	}
+
+	for _, crb := range crbList.Items {
+		ns, ok := strings.CutSuffix(crb.Name, clusterRoleBindingSuffix)
+		if !ok || !strings.HasPrefix(ns, nsPrefix) {
+			continue
+		}
+		// Deleted with the namespace by the next pass
+		if namespaces[ns] {
+			continue
+		}
+		if !isOrphan(ns, crb.CreationTimestamp, active, grace) {
+			continue
+		}
+
+		// The namespace may exist without the label, leave it alone then
+		_, err := e.kc.Client().CoreV1().Namespaces().Get(ctx, ns, metav1.GetOptions{})
+		if client.IgnoreNotFound(err) != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		if err == nil {
+			continue
+		}
+
+		err = e.kc.Client().RbacV1().ClusterRoleBindings().Delete(ctx, crb.Name, metav1.DeleteOptions{})
+		if client.IgnoreNotFound(err) != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		report.ClusterRoleBindings = append(report.ClusterRoleBindings, crb.Name)
+		metricGCDeleted.WithLabelValues("clusterrolebinding").Inc()
+	}
+
+	return report, nil
+}
+
+// logGCReport logs what a pass cleaned up, if anything
+func logGCReport(report *gcReport) {
+	if len(report.Namespaces) > 0 {
+		log.Println("Deleted", len(report.Namespaces), "orphan namespaces:", truncateList(report.Namespaces))
+	}
+	if len(report.ClusterRoleBindings) > 0 {
+		log.Println("Deleted", len(report.ClusterRoleBindings), "orphan cluster role bindings:", truncateList(report.ClusterRoleBindings))
+	}
+	for _, err := range report.Errors {
+		log.Println("Failed to collect garbage:", err)
+	}
+}
+
+func truncateList(items []string) string {
+	if len(items) <= maxGCLoggedObjects {
+		return strings.Join(items, ", ")
+	}
+	return strings.Join(items[:maxGCLoggedObjects], ", ") + ", ..."
+}
+
+func (m *Manager) gcLoop(ctx context.Context, e *kubeExecutor) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(*m.conf.GCInterval):
+		}
+
+		if !m.isLeader() {
+			continue
+		}
+
+		report, err := m.collectGarbage(ctx, e)
+		if err != nil {
+			log.Println("Failed to collect garbage:", err)
+			continue
+		}
+		logGCReport(report)
+		m.lastGC.Store(report)
+	}
+}
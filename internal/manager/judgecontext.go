@@ -0,0 +1,136 @@
+package manager
+
+import (
+	"encoding/json"
+
+	"github.com/lcpu-club/hpcgame-judger/pkg/aoiclient"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const contextKeyPrefix = "hpcgame.pku.edu.cn/"
+
+// JudgeContext describes what a session judges. The judge gets it as
+// environment variables, the namespace templates as .Context, and the
+// namespace and jobs are labeled and annotated with it.
+type JudgeContext struct {
+	SolutionId string
+	TaskId     string
+	UserId     string
+	ContestId  string
+	ManagerId  string
+
+	SolutionDataUrl  string
+	SolutionDataHash string
+	ProblemDataUrl   string
+	ProblemDataHash  string
+
+	Variables map[string]interface{}
+}
+
+func NewJudgeContext(soln *aoiclient.SolutionPoll, rc *RunningConfig, managerID string) *JudgeContext {
+	return &JudgeContext{
+		SolutionId:       soln.SolutionId,
+		TaskId:           soln.TaskId,
+		UserId:           soln.UserId,
+		ContestId:        soln.ContestId,
+		ManagerId:        managerID,
+		SolutionDataUrl:  soln.SolutionDataUrl,
+		SolutionDataHash: soln.SolutionDataHash,
+		ProblemDataUrl:   soln.ProblemDataUrl,
+		ProblemDataHash:  soln.ProblemDataHash,
+		Variables:        rc.Variables,
+	}
+}
+
+// Env returns the environment variables of the judge
+func (c *JudgeContext) Env() ([]corev1.EnvVar, error) {
+	variables := c.Variables
+	if variables == nil {
+		variables = map[string]interface{}{}
+	}
+	b, err := json.Marshal(variables)
+	if err != nil {
+		return nil, wrapError("variables", err)
+	}
+
+	return []corev1.EnvVar{
+		{Name: "SOLUTION_ID", Value: c.SolutionId},
+		{Name: "TASK_ID", Value: c.TaskId},
+		{Name: "USER_ID", Value: c.UserId},
+		{Name: "CONTEST_ID", Value: c.ContestId},
+		{Name: "MANAGER_ID", Value: c.ManagerId},
+		{Name: "SOLUTION_URL", Value: c.SolutionDataUrl},
+		{Name: "SOLUTION_HASH", Value: c.SolutionDataHash},
+		{Name: "PROBLEM_DATA_URL", Value: c.ProblemDataUrl},
+		{Name: "PROBLEM_DATA_HASH", Value: c.ProblemDataHash},
+		{Name: "JUDGE_VARIABLES", Value: string(b)},
+	}, nil
+}
+
+// Labels returns the IDs which can be selected on, those which aren't
+// valid label values are only annotated
+func (c *JudgeContext) Labels() map[string]string {
+	labels := make(map[string]string)
+	for k, v := range c.ids() {
+		if v != "" && len(validation.IsValidLabelValue(v)) == 0 {
+			labels[contextKeyPrefix+k] = v
+		}
+	}
+	return labels
+}
+
+// Annotations returns the IDs along with the data hashes and the manager
+func (c *JudgeContext) Annotations() map[string]string {
+	annotations := map[string]string{
+		contextKeyPrefix + "manager-id":         c.ManagerId,
+		contextKeyPrefix + "solution-data-hash": c.SolutionDataHash,
+		contextKeyPrefix + "problem-data-hash":  c.ProblemDataHash,
+	}
+	for k, v := range c.ids() {
+		annotations[contextKeyPrefix+k] = v
+	}
+	for k, v := range annotations {
+		if v == "" {
+			delete(annotations, k)
+		}
+	}
+	return annotations
+}
+
+func (c *JudgeContext) ids() map[string]string {
+	return map[string]string{
+		"solution-id": c.SolutionId,
+		"task-id":     c.TaskId,
+		"user-id":     c.UserId,
+		"contest-id":  c.ContestId,
+	}
+}
+
+// setEnv sets the variables in env, replacing those of the same names
+func setEnv(env []corev1.EnvVar, vars ...corev1.EnvVar) []corev1.EnvVar {
+	for _, v := range vars {
+		replaced := false
+		for k := range env {
+			if env[k].Name == v.Name {
+				env[k] = v
+				replaced = true
+			}
+		}
+		if !replaced {
+			env = append(env, v)
+		}
+	}
+	return env
+}
+
+// mergeMap sets the entries of src in dst, which is allocated if nil
+func mergeMap(dst map[string]string, src map[string]string) map[string]string {
+	if dst == nil {
+		dst = make(map[string]string, len(src))
+	}
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
@@ -0,0 +1,97 @@
+package manager
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Recovery and garbage collection are done by a single replica, elected
+// with a lock renewed for as long as it runs
+const (
+	leaderKey = "judge:leader"
+
+	leaderTimeout       = 30 * time.Second
+	leaderRenewInterval = 10 * time.Second
+)
+
+// elect acquires or renews the leadership, it reports whether this manager
+// is the leader
+func (m *Manager) elect() (bool, error) {
+	script := `
+	local owner = redis.call('GET', KEYS[1])
+	if owner == ARGV[1] then
+		redis.call('PEXPIRE', KEYS[1], ARGV[2])
+		return 1
+	end
+	if owner then
+		return 0
+	end
+
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+	`
+
+	res, err := m.r.Eval(context.TODO(), script, []string{leaderKey},
+		m.ID(), leaderTimeout.Milliseconds()).Int()
+	return res == 1, err
+}
+
+func (m *Manager) isLeader() bool {
+	return m.leading.Load()
+}
+
+func (m *Manager) setLeader(leading bool) {
+	if m.leading.Swap(leading) == leading {
+		return
+	}
+
+	if leading {
+		log.Println("Elected as leader")
+		metricLeader.Set(1)
+	} else {
+		log.Println("No longer the leader")
+		metricLeader.Set(0)
+	}
+}
+
+// electLoop keeps trying to be the leader until ctx is done, then steps
+// down so another replica takes over right away
+func (m *Manager) electLoop(ctx context.Context) {
+	ticker := time.NewTicker(leaderRenewInterval)
+	defer ticker.Stop()
+
+	var renewed time.Time
+	for {
+		leading, err := m.elect()
+		if err != nil {
+			log.Println("Failed to elect leader:", err)
+			// The lock may have expired by now
+			leading = m.isLeader() && time.Since(renewed) < leaderTimeout
+		} else if leading {
+			renewed = time.Now()
+		}
+		m.setLeader(leading)
+
+		select {
+		case <-ctx.Done():
+			m.stepDown()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Manager) stepDown() {
+	if !m.isLeader() {
+		return
+	}
+	m.setLeader(false)
+
+	err := m.r.ReleaseLock(leaderKey, m.ID())
+	if err != nil && err != redis.Nil && err != redis.TxFailedErr {
+		log.Println("Failed to step down:", err)
+	}
+}
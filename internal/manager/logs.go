@@ -0,0 +1,194 @@
+package manager
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Log messages of the judge are kept in a capped Redis stream while the
+// session is alive. Once it's over, they are archived as a file on the
+// shared volume, and the stream expires after logRetention.
+const (
+	logStreamMaxLen = 10000
+	logRetention    = 24 * time.Hour
+
+	logFollowBlock = 5 * time.Second
+)
+
+func logStreamKey(id string) string {
+	return fmt.Sprintf("judge:log:%s", id)
+}
+
+// logArchivePath returns <shared volume>/logs/<solution>/<task>.log
+func (m *Manager) logArchivePath(id string) string {
+	name := strings.ReplaceAll(strings.TrimPrefix(id, solnKeyPrefix), ":", "/")
+	return filepath.Join(*m.conf.SharedVolumePath, "logs", filepath.Clean("/"+name)+".log")
+}
+
+// appendLog records a message of the judge. It's best effort, the caller
+// only logs the error so that the logs never fail the judging.
+func (s *JudgeSession) appendLog(action string, msg string) error {
+	return s.m.r.XAdd(context.TODO(), &redis.XAddArgs{
+		Stream: logStreamKey(s.id),
+		MaxLen: logStreamMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"stage":  s.stage,
+			"action": action,
+			"msg":    msg,
+		},
+	}).Err()
+}
+
+func formatLogEntry(msg redis.XMessage) string {
+	// IDs are <milliseconds>-<sequence>
+	t := msg.ID
+	ms, _, _ := strings.Cut(msg.ID, "-")
+	if v, err := strconv.ParseInt(ms, 10, 64); err == nil {
+		t = time.UnixMilli(v).UTC().Format(time.RFC3339Nano)
+	}
+
+	return fmt.Sprintf("%s [%v] %v: %v\n", t, msg.Values["stage"], msg.Values["action"], msg.Values["msg"])
+}
+
+// archiveLogs writes the log stream to the shared volume, the stream is
+// kept for logRetention so that it can still be followed for a while
+func (s *JudgeSession) archiveLogs() error {
+	key := logStreamKey(s.id)
+	msgs, err := s.m.r.XRange(context.TODO(), key, "-", "+").Result()
+	if err != nil {
+		return err
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	path := s.m.logArchivePath(s.id)
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	// Written at once, a retried session appends to the same stream
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, msg := range msgs {
+		_, err = w.WriteString(formatLogEntry(msg))
+		if err != nil {
+			return err
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	log.Println("Archived", len(msgs), "log messages to", path)
+
+	return s.m.r.Expire(context.TODO(), key, logRetention).Err()
+}
+
+// handleSessionLogs writes the log of a session as plain text, with
+// ?follow=true it keeps writing new messages until the session is over
+func (m *Manager) handleSessionLogs(w http.ResponseWriter, r *http.Request) {
+	id, ok := sessionIDOf(w, r)
+	if !ok {
+		return
+	}
+
+	key := logStreamKey(id)
+	ctx := r.Context()
+
+	n, err := m.r.Exists(ctx, key).Result()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if n == 0 {
+		// Expired, read from the archive instead
+		f, err := os.Open(m.logArchivePath(id))
+		if os.IsNotExist(err) {
+			http.Error(w, "logs not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.Copy(w, f)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	flusher, _ := w.(http.Flusher)
+	follow := r.URL.Query().Get("follow") == "true"
+
+	// A negative duration doesn't block at all
+	block := time.Duration(-1)
+	if follow {
+		block = logFollowBlock
+	}
+
+	last := "0"
+	for {
+		streams, err := m.r.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{key, last},
+			Count:   1000,
+			Block:   block,
+		}).Result()
+		if err != nil && err != redis.Nil {
+			if ctx.Err() == nil {
+				log.Println("Failed to read logs:", err)
+			}
+			return
+		}
+
+		var msgs []redis.XMessage
+		if len(streams) > 0 {
+			msgs = streams[0].Messages
+		}
+		for _, msg := range msgs {
+			_, err = io.WriteString(w, formatLogEntry(msg))
+			if err != nil {
+				return
+			}
+			last = msg.ID
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if len(msgs) > 0 {
+			continue
+		}
+
+		// Caught up, wait for more only while the session is alive
+		if !follow {
+			return
+		}
+		alive, err := m.r.Exists(ctx, id).Result()
+		if err != nil || alive == 0 {
+			return
+		}
+	}
+}
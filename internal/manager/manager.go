@@ -1,34 +1,70 @@
 package manager
 
 import (
+	"context"
 	"errors"
 	"log"
 	"os"
-	"text/template"
+	"sync"
+	"sync/atomic"
 
 	"github.com/lcpu-club/hpcgame-judger/internal/config"
-	"github.com/lcpu-club/hpcgame-judger/internal/kube"
+	"github.com/lcpu-club/hpcgame-judger/internal/policy"
 	"github.com/lcpu-club/hpcgame-judger/internal/utils"
 	"github.com/lcpu-club/hpcgame-judger/pkg/aoiclient"
 )
 
 type Manager struct {
 	conf *config.ManagerConfig
-	sm   *utils.SecretManager
-	kc   *kube.Client
+	exec Executor
 	aoi  *aoiclient.Client
 	r    *Redis
 	rl   *RateLimiter
+	q    *AdmissionQueue
+
+	pools map[string]*RateLimiter
+	// Nil if problem data isn't cached
+	data *dataCache
+	// Checked before judge objects are created
+	policy *policy.Policy
 
 	managerID string
 
-	tmpls []*template.Template
+	// Swapped on changes, sessions keep the set they started with
+	tmpls *atomic.Pointer[TemplateSet]
+	// Last garbage collection pass
+	lastGC *atomic.Pointer[gcReport]
+
+	// Whether this replica does recovery and garbage collection
+	leading *atomic.Bool
+
+	sessions     map[string]*JudgeSession
+	sessionsLock *sync.Mutex
+
+	runs *sync.WaitGroup
+	// Guards adding to runs against the drain stopping new ones
+	runsLock *sync.Mutex
+	state    *atomic.Int32
+	// Closed when the hand off starts
+	handOffChan chan struct{}
 }
 
 func NewManager(conf *config.ManagerConfig) *Manager {
 	return &Manager{
 		conf: conf,
-		sm:   utils.NewSecretManager(*conf.KubeSecretPath),
+
+		sessions:     make(map[string]*JudgeSession),
+		sessionsLock: &sync.Mutex{},
+
+		tmpls:  new(atomic.Pointer[TemplateSet]),
+		lastGC: new(atomic.Pointer[gcReport]),
+
+		leading: new(atomic.Bool),
+
+		runs:        &sync.WaitGroup{},
+		runsLock:    &sync.Mutex{},
+		state:       new(atomic.Int32),
+		handOffChan: make(chan struct{}),
 	}
 }
 
@@ -48,11 +84,10 @@ func (m *Manager) genID() {
 }
 
 func (m *Manager) Init() error {
-	kc, err := kube.NewClient(*m.conf.Kubernetes, m.sm)
+	err := m.initExecutor()
 	if err != nil {
 		return err
 	}
-	m.kc = kc
 
 	aoi := aoiclient.New(*m.conf.Endpoint)
 	if *m.conf.RunnerID != "" || *m.conf.RunnerKey != "" {
@@ -70,20 +105,91 @@ func (m *Manager) Init() error {
 
 	m.genID()
 
-	err = m.loadTemplates()
+	m.q = NewAdmissionQueue(m.r, "queue", m.poolNameOf)
+	registerQueueMetrics(m.q)
+
+	m.rl = NewRateLimiter(m.r, "ratelimit:leases", "ratelimit:total", m.managerID)
+	registerRateLimitMetrics(m.rl)
+	err = m.rl.Init(*m.conf.RateLimit)
 	if err != nil {
 		return err
 	}
 
-	m.rl = NewRateLimiter(m.r, "ratelimit", "ratelimit:total")
-	return m.rl.Init(*m.conf.RateLimit)
+	if *m.conf.CacheProblemData {
+		m.data = newDataCache(*m.conf.SharedVolumePath)
+	}
+
+	err = m.initPolicy()
+	if err != nil {
+		return err
+	}
+
+	return m.initPools()
 }
 
-func (m *Manager) Start() error {
-	go m.findNotRunningLoop()
-	return m.pollLoop()
+// Start runs the manager until ctx is done, then drains the sessions
+func (m *Manager) Start(ctx context.Context) error {
+	go m.electLoop(ctx)
+	go m.findNotRunningLoop(ctx)
+	go m.dispatchLoop(ctx)
+	go m.eventLoop()
+	go m.serveAPI()
+	if m.tmpls.Load() != nil {
+		go m.watchTemplates(ctx)
+	}
+	if e, ok := m.exec.(*kubeExecutor); ok && *m.conf.GCInterval > 0 {
+		go m.gcLoop(ctx, e)
+	}
+
+	err := m.pollLoop(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.drain()
+	return nil
 }
 
 func (m *Manager) ID() string {
 	return m.managerID
 }
+
+func (m *Manager) registerSession(s *JudgeSession) {
+	m.sessionsLock.Lock()
+	defer m.sessionsLock.Unlock()
+
+	m.sessions[s.id] = s
+
+	// Locked after the hand off started, pass it on as well
+	if m.state.Load() == stateHandingOff {
+		s.Stop(errSessionHandedOff)
+	}
+}
+
+func (m *Manager) unregisterSession(s *JudgeSession) {
+	m.sessionsLock.Lock()
+	defer m.sessionsLock.Unlock()
+
+	if m.sessions[s.id] == s {
+		delete(m.sessions, s.id)
+	}
+}
+
+func (m *Manager) listSessions() []*JudgeSession {
+	m.sessionsLock.Lock()
+	defer m.sessionsLock.Unlock()
+
+	sessions := make([]*JudgeSession, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// getSession returns the session with the given ID if it's running on this manager
+func (m *Manager) getSession(id string) *JudgeSession {
+	m.sessionsLock.Lock()
+	defer m.sessionsLock.Unlock()
+
+	return m.sessions[id]
+}
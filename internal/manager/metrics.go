@@ -0,0 +1,163 @@
+package manager
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/lcpu-club/hpcgame-judger/pkg/aoiclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "hpcgame_judger"
+
+var (
+	metricPolls = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "polls_total",
+		Help:      "Number of polls sent to AOI",
+	})
+	metricEmptyPolls = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "empty_polls_total",
+		Help:      "Number of polls which returned no solution",
+	})
+	metricAdmissions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "admissions_total",
+		Help:      "Number of admitted solutions",
+	})
+	metricAdmissionFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "admission_failures_total",
+		Help:      "Number of solutions failed to be admitted",
+	})
+	metricSessions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sessions_total",
+		Help:      "Number of finished judge sessions by outcome",
+	}, []string{"outcome"})
+	metricNamespaceCreation = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "namespace_creation_seconds",
+		Help:      "Time from session start until the namespace is created",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+	metricJobReady = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "job_ready_seconds",
+		Help:      "Time from session start until the judge job is ready",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+	})
+	metricSessionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "session_duration_seconds",
+		Help:      "Total time of a judge session",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+	})
+	metricActions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "protocol_actions_total",
+		Help:      "Number of processed protocol messages by action",
+	}, []string{"action"})
+	metricAOIErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "aoi_errors_total",
+		Help:      "Number of errors returned by the AOI API by error name",
+	}, []string{"error"})
+	metricTemplateReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "template_reloads_total",
+		Help:      "Number of namespace template reloads by result",
+	}, []string{"result"})
+	metricProblemData = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "problem_data_total",
+		Help:      "Number of problem data lookups in the cache by result",
+	}, []string{"result"})
+	metricLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "leader",
+		Help:      "Whether this replica is the leader doing recovery and garbage collection",
+	})
+	metricGCDeleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gc_deleted_total",
+		Help:      "Number of orphan objects deleted by the garbage collection by kind",
+	}, []string{"kind"})
+)
+
+const (
+	outcomeSuccess   = "success"
+	outcomeFailed    = "failed"
+	outcomeCancelled = "cancelled"
+	outcomeRequeued  = "requeued"
+	outcomeHandedOff = "handed_off"
+	outcomeRetried   = "retried"
+	outcomeLocked    = "locked"
+)
+
+// registerRateLimitMetrics exposes the token counters of rl, which are
+// shared by all replicas
+func registerRateLimitMetrics(rl *RateLimiter) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "ratelimit_tokens_in_use",
+		Help:      "Number of rate limit tokens in use",
+	}, gaugeOf(rl.Current)))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "ratelimit_tokens",
+		Help:      "Number of rate limit tokens in total",
+	}, gaugeOf(rl.Total)))
+}
+
+func registerPoolMetrics(name string, rl *RateLimiter) {
+	labels := prometheus.Labels{"pool": name}
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Name:        "pool_tokens_in_use",
+		Help:        "Number of concurrency pool tokens in use",
+		ConstLabels: labels,
+	}, gaugeOf(rl.Current)))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Name:        "pool_tokens",
+		Help:        "Number of concurrency pool tokens in total",
+		ConstLabels: labels,
+	}, gaugeOf(rl.Total)))
+}
+
+func registerQueueMetrics(q *AdmissionQueue) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_length",
+		Help:      "Number of solutions waiting in the admission queue",
+	}, gaugeOf(q.Len)))
+}
+
+func gaugeOf(f func() (int64, error)) func() float64 {
+	return func() float64 {
+		v, err := f()
+		if err != nil {
+			log.Println("Failed to collect metric:", err)
+			return 0
+		}
+		return float64(v)
+	}
+}
+
+func observeSince(h prometheus.Histogram, t time.Time) {
+	h.Observe(time.Since(t).Seconds())
+}
+
+// observeAOIError counts err if it's returned by the AOI API, err is
+// returned as is
+func observeAOIError(err error) error {
+	var apiErr *aoiclient.APIError
+	if errors.As(err, &apiErr) {
+		metricAOIErrors.WithLabelValues(apiErr.ErrorName).Inc()
+	}
+	return err
+}
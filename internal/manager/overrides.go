@@ -0,0 +1,118 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+// JobOverride changes the job template of a problem for some of its
+// solutions, e.g. more resources or another image for a track, without
+// repeating the whole template
+type JobOverride struct {
+	// Name is only used in errors
+	Name string `json:"name,omitempty"`
+	// When selects the solutions, every solution if not set
+	When *OverrideCondition `json:"when,omitempty"`
+	// Stages limits the override to some stages, every stage if empty
+	Stages []string `json:"stages,omitempty"`
+
+	// Merge is a strategic merge patch of the Job
+	Merge json.RawMessage `json:"merge,omitempty"`
+	// Patch is a JSON patch (RFC 6902) of the Job, applied after Merge
+	Patch json.RawMessage `json:"patch,omitempty"`
+}
+
+// OverrideCondition matches if every condition which is set matches
+type OverrideCondition struct {
+	// Contests matches the solutions of any of the contests
+	Contests []string `json:"contests,omitempty"`
+	// Variables matches if the variables have the given values
+	Variables map[string]interface{} `json:"variables,omitempty"`
+}
+
+func (c *OverrideCondition) matches(jc *JudgeContext) bool {
+	if c == nil {
+		return true
+	}
+
+	if len(c.Contests) > 0 && !slices.Contains(c.Contests, jc.ContestId) {
+		return false
+	}
+
+	for k, v := range c.Variables {
+		if !reflect.DeepEqual(jc.Variables[k], v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (o *JobOverride) appliesTo(stage string) bool {
+	return len(o.Stages) == 0 || slices.Contains(o.Stages, stage)
+}
+
+func (o *JobOverride) String() string {
+	if o.Name != "" {
+		return o.Name
+	}
+	return "unnamed"
+}
+
+// applyOverrides returns a copy of job with the matching overrides applied
+// in order
+func applyOverrides(job *batchv1.Job, overrides []*JobOverride, jc *JudgeContext) (*batchv1.Job, error) {
+	var matched []*JobOverride
+	for _, o := range overrides {
+		if o.When.matches(jc) {
+			matched = append(matched, o)
+		}
+	}
+	if len(matched) == 0 {
+		return job.DeepCopy(), nil
+	}
+
+	doc, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, o := range matched {
+		if len(o.Merge) > 0 {
+			doc, err = strategicpatch.StrategicMergePatch(doc, o.Merge, &batchv1.Job{})
+			if err != nil {
+				return nil, fmt.Errorf("override %s: merge: %w", o, err)
+			}
+		}
+
+		if len(o.Patch) > 0 {
+			patch, err := jsonpatch.DecodePatch(o.Patch)
+			if err != nil {
+				return nil, fmt.Errorf("override %s: patch: %w", o, err)
+			}
+			doc, err = patch.Apply(doc)
+			if err != nil {
+				return nil, fmt.Errorf("override %s: patch: %w", o, err)
+			}
+		}
+	}
+
+	// Fields the Job doesn't have would be dropped silently, most likely
+	// they are typos
+	result := &batchv1.Job{}
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(result)
+	if err != nil {
+		return nil, fmt.Errorf("overridden job: %w", err)
+	}
+
+	return result, nil
+}
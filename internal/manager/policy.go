@@ -0,0 +1,69 @@
+package manager
+
+import (
+	"errors"
+	"log"
+
+	"github.com/lcpu-club/hpcgame-judger/internal/policy"
+	"github.com/lcpu-club/hpcgame-judger/pkg/aoiclient"
+	batchv1 "k8s.io/api/batch/v1"
+)
+
+// initPolicy loads the admission policy of the judge jobs and namespace
+// objects, the default one if no file is given
+func (m *Manager) initPolicy() error {
+	if *m.conf.PolicyFile == "" {
+		m.policy = policy.Default()
+		return nil
+	}
+
+	p, err := policy.Load(*m.conf.PolicyFile)
+	if err != nil {
+		return err
+	}
+	m.policy = p
+	return nil
+}
+
+// CheckPolicy checks the rendered objects and jobs of a session against p,
+// violations fail the solution instead of being retried
+func CheckPolicy(p *policy.Policy, objects []string, jobs []*batchv1.Job) error {
+	var violations []*policy.Violation
+	collect := func(err error) error {
+		var pe *policy.Error
+		if errors.As(err, &pe) {
+			violations = append(violations, pe.Violations...)
+			return nil
+		}
+		return err
+	}
+
+	for _, doc := range objects {
+		err := collect(p.CheckObjects(doc))
+		if err != nil {
+			return err
+		}
+	}
+	for _, job := range jobs {
+		err := collect(p.CheckJob(job))
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+	return newStatusError(aoiclient.StatusError, "Judge config violates the policy: %v",
+		&policy.Error{Violations: violations})
+}
+
+// checkPolicy checks the session against the policy of the manager, the
+// violations are logged for the admins
+func (s *JudgeSession) checkPolicy(objects []string, jobs []*batchv1.Job) error {
+	err := CheckPolicy(s.m.policy, objects, jobs)
+	if err != nil {
+		log.Println("Session", s.id, "rejected:", err)
+	}
+	return err
+}
@@ -2,48 +2,158 @@ package manager
 
 import (
 	"context"
+	"errors"
 	"log"
 	"time"
 
 	"github.com/lcpu-club/hpcgame-judger/pkg/aoiclient"
+	"github.com/redis/go-redis/v9"
 )
 
 const pollInterval = 250 * time.Millisecond
 
-func (m *Manager) pollLoop() error {
+// pollLoop polls solutions from AOI into the admission queue, as long as
+// the queue is not full
+func (m *Manager) pollLoop(ctx context.Context) error {
 	for {
-		time.Sleep(pollInterval)
+		select {
+		case <-ctx.Done():
+			log.Println("Stopped polling")
+			return nil
+		case <-time.After(pollInterval):
+		}
 
-		ok, err := m.rl.Request()
+		n, err := m.q.Len()
 		if err != nil {
-			log.Println("Failed to request rate limit:", err)
+			log.Println("Failed to get queue length:", err)
 			continue
-			// return err
 		}
 
-		if !ok {
+		if n >= *m.conf.QueueSize {
 			continue
 		}
 
-		polled, err := m.poll()
+		_, err = m.poll()
 		if err != nil {
 			log.Println("Failed to poll:", err)
 		}
-		if err != nil || !polled {
-			m.rl.Release()
+	}
+}
+
+// dispatchLoop runs queued solutions whenever a rate limit token is available
+func (m *Manager) dispatchLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pollInterval):
+		}
+
+		// Pools found full are passed over for the rest of the tick
+		full := make(map[string]bool)
+		for i := 0; i < maxDispatchPerTick && m.dispatch(full); i++ {
+		}
+	}
+}
+
+// Bounds the number of solutions started in a tick
+const maxDispatchPerTick = 64
+
+// Taking is retried when the queue changes after the solution is found
+const takeAttempts = 3
+
+// dispatch runs the next queued solution, it returns false if there is
+// nothing to run or no token available
+func (m *Manager) dispatch(full map[string]bool) bool {
+	lease, err := m.rl.Request()
+	if err != nil {
+		log.Println("Failed to request rate limit:", err)
+		return false
+	}
+
+	if lease == nil {
+		return false
+	}
+
+	id, poolLease, err := m.take(full)
+	if err != nil {
+		log.Println("Failed to pop queue:", err)
+	}
+	if err != nil || id == "" {
+		lease.Release()
+		return false
+	}
+
+	soln, err := m.r.GetSolutionPoll(id)
+	if err == redis.Nil {
+		// Cancelled while queued
+		releaseLeases([]*Lease{lease, poolLease})
+		m.releaseClaim(id)
+		return true
+	}
+	if err != nil {
+		log.Println("Failed to get solution:", err)
+		releaseLeases([]*Lease{lease, poolLease})
+		m.releaseClaim(id)
+		return false
+	}
+
+	if !m.goRun(id, lease, poolLease) {
+		// Draining, left for the other replicas
+		releaseLeases([]*Lease{lease, poolLease})
+		err = m.q.Push(id, soln)
+		if err != nil {
+			log.Println("Failed to queue solution:", err)
+		}
+		m.releaseClaim(id)
+		return false
+	}
+	return true
+}
+
+// take takes the next queued solution with a token of its pool, along with
+// the token. Solutions of full pools keep their place, and the pools are
+// added to full.
+func (m *Manager) take(full map[string]bool) (string, *Lease, error) {
+	for i := 0; i < takeAttempts; {
+		entry, err := m.q.Next(full)
+		if err != nil || entry == nil {
+			return "", nil, err
+		}
+
+		poolLease, ok, err := m.requestPool(entry.Pool)
+		if err != nil {
+			return "", nil, err
+		}
+		if !ok {
+			full[entry.Pool] = true
+			continue
+		}
+
+		ok, err = m.q.Take(entry, m.ID())
+		if err != nil || !ok {
+			releaseLeases([]*Lease{poolLease})
+			if err != nil {
+				return "", nil, err
+			}
+			i++
 			continue
 		}
+		return entry.ID, poolLease, nil
 	}
+	return "", nil, nil
 }
 
 func (m *Manager) poll() (bool, error) {
+	metricPolls.Inc()
 	soln, err := m.aoi.Poll(context.TODO())
 	if err != nil {
-		return false, err
+		return false, observeAOIError(err)
 	}
 
 	if soln.SolutionId == "" || soln.TaskId == "" {
 		// No solution to poll
+		metricEmptyPolls.Inc()
 		return false, nil
 	}
 
@@ -52,8 +162,9 @@ func (m *Manager) poll() (bool, error) {
 	err = m.solnAdmission(soln)
 	if err != nil {
 		log.Println("Failed to admit solution:", err)
+		metricAdmissionFailures.Inc()
 
-		errF := m.failSoln(soln, "Failed to admit solution")
+		errF := m.failSoln(soln, aoiclient.StatusError, "Failed to admit solution")
 		if errF != nil {
 			log.Println("Failed to fail solution:", err)
 		}
@@ -65,48 +176,143 @@ func (m *Manager) poll() (bool, error) {
 }
 
 func (m *Manager) solnAdmission(soln *aoiclient.SolutionPoll) error {
-	id, err := m.r.StoreSolutionPoll(soln)
+	// Owned until it's queued
+	id := solutionPollID(soln)
+	err := m.r.Set(context.TODO(), claimKeyOf(id), m.ID(), claimTimeout).Err()
 	if err != nil {
 		return err
 	}
-	go m.run(id)
+	defer m.releaseClaim(id)
+
+	_, err = m.r.StoreSolutionPoll(soln)
+	if err != nil {
+		return err
+	}
+
+	err = m.q.Push(id, soln)
+	if err != nil {
+		return err
+	}
+
+	metricAdmissions.Inc()
 	return nil
 }
 
-func (m *Manager) failSoln(soln *aoiclient.SolutionPoll, reason string) error {
+func (m *Manager) failSoln(soln *aoiclient.SolutionPoll, status string, reason string) error {
 	s := m.aoi.Solution(soln.SolutionId, soln.TaskId)
-	s.Patch(context.TODO(), &aoiclient.SolutionInfo{
+	observeAOIError(s.Patch(context.TODO(), &aoiclient.SolutionInfo{
 		Score:   0,
-		Status:  aoiclient.StatusError,
+		Status:  status,
 		Message: reason,
-	})
+	}))
 	err := s.SaveDetails(context.TODO(), &aoiclient.SolutionDetails{
 		Summary: reason,
 	})
 	if err != nil {
-		return err
+		return observeAOIError(err)
+	}
+	return observeAOIError(s.Complete(context.TODO()))
+}
+
+// goRun runs the session in background with the claim and the rate limit
+// leases held by the caller, which are renewed until the run is over. It
+// returns false once the manager is draining, the caller keeps them then.
+func (m *Manager) goRun(id string, leases ...*Lease) bool {
+	m.runsLock.Lock()
+	defer m.runsLock.Unlock()
+
+	if m.state.Load() != stateRunning {
+		return false
 	}
-	return s.Complete(context.TODO())
+
+	m.runs.Add(1)
+	go func() {
+		defer m.runs.Done()
+		defer releaseLeases(leases)
+		defer m.releaseClaim(id)
+
+		stop := make(chan struct{})
+		defer close(stop)
+		go renewLeases(leases, stop)
+		go m.keepClaim(id, stop)
+
+		m.run(id)
+	}()
+	return true
 }
 
 func (m *Manager) run(id string) error {
 	log.Println("Running solution", id)
-	defer m.rl.Release()
 
-	sess, err := NewJudgeSession(id, m)
-	if err != nil {
-		return err
-	}
+	for {
+		sess, err := NewJudgeSession(id, m)
+		if err != nil {
+			log.Println("Failed to create session:", err)
+			return err
+		}
 
-	err = sess.Run()
+		err = sess.Run()
 
-	if err != nil {
-		log.Println("Failed to run session:", err)
-		fErr := m.failSoln(sess.soln, "Failed to run session: "+err.Error())
-		if fErr != nil {
-			log.Println("Failed to fail solution:", fErr)
+		if errors.Is(err, errSessionLocked) {
+			log.Println("Solution", id, "is running on another manager")
+			metricSessions.WithLabelValues(outcomeLocked).Inc()
+			return nil
 		}
-	}
 
-	return nil
+		if errors.Is(err, errSessionRequeued) {
+			log.Println("Requeued solution", id)
+			metricSessions.WithLabelValues(outcomeRequeued).Inc()
+			// Waits for its turn and its pool again
+			qErr := m.q.Push(id, sess.soln)
+			if qErr != nil {
+				log.Println("Failed to queue solution, left for recovery:", qErr)
+			}
+			return nil
+		}
+
+		var retry *retryError
+		if errors.As(err, &retry) {
+			log.Println("Retrying solution", id, "after", err)
+			metricSessions.WithLabelValues(outcomeRetried).Inc()
+			if m.sleepUnlessHandingOff(m.retryBackoff(retry.attempt)) {
+				continue
+			}
+			err = errSessionHandedOff
+		}
+
+		if errors.Is(err, errSessionHandedOff) {
+			log.Println("Handed off solution", id)
+			metricSessions.WithLabelValues(outcomeHandedOff).Inc()
+			m.handOff(id)
+			return nil
+		}
+
+		if errors.Is(err, errSessionCancelled) {
+			log.Println("Cancelled solution", id)
+			metricSessions.WithLabelValues(outcomeCancelled).Inc()
+			fErr := m.failSoln(sess.soln, aoiclient.StatusError, "Judging cancelled by administrator")
+			if fErr != nil {
+				log.Println("Failed to fail solution:", fErr)
+			}
+			return nil
+		}
+
+		if err != nil {
+			log.Println("Failed to run session:", err)
+			metricSessions.WithLabelValues(outcomeFailed).Inc()
+			status, ok := statusOf(err)
+			reason := err.Error()
+			if !ok {
+				reason = "Failed to run session: " + reason
+			}
+			fErr := m.failSoln(sess.soln, status, reason)
+			if fErr != nil {
+				log.Println("Failed to fail solution:", fErr)
+			}
+			return nil
+		}
+
+		metricSessions.WithLabelValues(outcomeSuccess).Inc()
+		return nil
+	}
 }
@@ -0,0 +1,99 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/lcpu-club/hpcgame-judger/pkg/aoiclient"
+)
+
+// Concurrency pools limit the number of running sessions of a kind of
+// problems, on top of the global rate limit. A session belongs to the pool
+// named by RunningConfig.Pool, or else to the pool named after the problem
+// label, if such a pool is configured.
+
+const poolKeyPrefix = "ratelimit:pool:"
+
+// parsePoolLimits parses limits in the form of "name=limit,name=limit"
+func parsePoolLimits(s string) (map[string]int64, error) {
+	limits := make(map[string]int64)
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, limit, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid pool limit: %s", item)
+		}
+
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pool limit: %s", item)
+		}
+		limits[name] = n
+	}
+
+	return limits, nil
+}
+
+func (m *Manager) initPools() error {
+	limits, err := parsePoolLimits(*m.conf.PoolLimits)
+	if err != nil {
+		return err
+	}
+
+	m.pools = make(map[string]*RateLimiter)
+	for name, limit := range limits {
+		rl := NewRateLimiter(m.r, poolKeyPrefix+name+":leases", poolKeyPrefix+name+":total", m.managerID)
+		err := rl.Init(limit)
+		if err != nil {
+			return err
+		}
+		registerPoolMetrics(name, rl)
+
+		m.pools[name] = rl
+		log.Println("Using pool", name, "with limit", limit)
+	}
+
+	return nil
+}
+
+// poolNameOf returns the pool of the solution, or empty string if not limited
+func (m *Manager) poolNameOf(soln *aoiclient.SolutionPoll) string {
+	rc := new(RunningConfig)
+	err := json.Unmarshal(soln.ProblemConfig.Judge.Config, rc)
+	if err == nil && rc.Pool != "" {
+		if _, ok := m.pools[rc.Pool]; !ok {
+			log.Println("Pool", rc.Pool, "is not configured, not limited")
+			return ""
+		}
+		return rc.Pool
+	}
+
+	if _, ok := m.pools[soln.ProblemConfig.Label]; ok {
+		return soln.ProblemConfig.Label
+	}
+	return ""
+}
+
+// requestPool takes a token from the pool, it returns false if the pool is
+// full, and a nil lease if there is no such pool
+func (m *Manager) requestPool(name string) (*Lease, bool, error) {
+	pool := m.pools[name]
+	if pool == nil {
+		return nil, true, nil
+	}
+
+	lease, err := pool.Request()
+	if err != nil || lease == nil {
+		return nil, false, err
+	}
+
+	return lease, true, nil
+}
@@ -10,11 +10,8 @@ import (
 	"github.com/lcpu-club/hpcgame-judger/pkg/judgerproto"
 )
 
-func (s *JudgeSession) processMessage(msg string) error {
-	m, err := judgerproto.MessageFromString(msg)
-	if err != nil {
-		return err
-	}
+func (s *JudgeSession) processMessage(m *judgerproto.Message) error {
+	metricActions.WithLabelValues(m.Action.Name()).Inc()
 
 	switch m.Action {
 	case judgerproto.ActionError:
@@ -24,6 +21,11 @@ func (s *JudgeSession) processMessage(msg string) error {
 			if err != nil {
 				return err
 			}
+
+			err = s.appendLog(m.Action.Name(), string(body))
+			if err != nil {
+				log.Println("Failed to append log:", err)
+			}
 			return errors.New(string(body))
 		}
 	case judgerproto.ActionLog:
@@ -33,19 +35,25 @@ func (s *JudgeSession) processMessage(msg string) error {
 			if err != nil {
 				return err
 			}
-			// TODO: Log logics
 			log.Println("Log from", s.GetNamespaceName(), ":", string(body))
+
+			err = s.appendLog(m.Action.Name(), string(body))
+			if err != nil {
+				log.Println("Failed to append log:", err)
+			}
 		}
 	case judgerproto.ActionComplete:
 		{
-			err := s.aoi.Complete(context.TODO())
+			err := observeAOIError(s.aoi.Complete(context.TODO()))
 			if err != nil {
 				return wrapError("aoiComplete", err)
 			}
+			s.completed = true
 		}
 	case judgerproto.ActionQuit:
 		{
-			s.deleteNamespace()
+			s.quit = true
+			s.teardown()
 		}
 	case judgerproto.ActionPatch:
 		{
@@ -55,7 +63,7 @@ func (s *JudgeSession) processMessage(msg string) error {
 				return err
 			}
 
-			err = s.aoi.Patch(context.TODO(), (*aoiclient.SolutionInfo)(&body))
+			err = observeAOIError(s.aoi.Patch(context.TODO(), (*aoiclient.SolutionInfo)(&body)))
 			if err != nil {
 				return wrapError("aoiPatch", err)
 			}
@@ -68,7 +76,7 @@ func (s *JudgeSession) processMessage(msg string) error {
 				return wrapError("unmarshalDetail", err)
 			}
 
-			err = s.aoi.SaveDetails(context.TODO(), (*aoiclient.SolutionDetails)(&body))
+			err = observeAOIError(s.aoi.SaveDetails(context.TODO(), (*aoiclient.SolutionDetails)(&body)))
 			if err != nil {
 				return wrapError("aoiSaveDetails", err)
 			}
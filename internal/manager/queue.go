@@ -0,0 +1,358 @@
+package manager
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/lcpu-club/hpcgame-judger/pkg/aoiclient"
+)
+
+// AdmissionQueue holds admitted solutions until a rate limit token is
+// available. Solutions are dispatched in smooth weighted round-robin over
+// contests, then in round-robin over the users of the contest, so that a
+// single user can't take all the capacity. Solutions of a full pool are
+// passed over in place, so that they don't hold up the others.
+//
+// Keys under prefix:
+//
+//	:pending                 set of all queued IDs
+//	:contests                set of contests with queued solutions
+//	:users:<contest>         list of users with queued solutions, rotated
+//	:items:<contest>:<user>  list of queued IDs of the user
+//	:pools                   hash of the pools of queued IDs, if limited
+//	:weights                 hash of contest weights, 1 if absent
+//	:credits                 hash of current round-robin credits
+type AdmissionQueue struct {
+	r *Redis
+
+	prefix string
+	// Returns the pool of a solution, empty if not limited
+	poolOf func(soln *aoiclient.SolutionPoll) string
+}
+
+func NewAdmissionQueue(r *Redis, prefix string, poolOf func(soln *aoiclient.SolutionPoll) string) *AdmissionQueue {
+	return &AdmissionQueue{
+		r:      r,
+		prefix: prefix,
+		poolOf: poolOf,
+	}
+}
+
+func (q *AdmissionQueue) key(parts ...string) string {
+	return q.prefix + ":" + strings.Join(parts, ":")
+}
+
+func (q *AdmissionQueue) Push(id string, soln *aoiclient.SolutionPoll) error {
+	script := `
+	local pending, items, users, contests, pools = KEYS[1], KEYS[2], KEYS[3], KEYS[4], KEYS[5]
+	local id, contest, user, pool = ARGV[1], ARGV[2], ARGV[3], ARGV[4]
+
+	if redis.call('SADD', pending, id) == 0 then
+		return 0
+	end
+
+	if redis.call('RPUSH', items, id) == 1 then
+		redis.call('LPUSH', users, user)
+	end
+	redis.call('SADD', contests, contest)
+	if pool ~= '' then
+		redis.call('HSET', pools, id, pool)
+	end
+
+	return 1
+	`
+
+	return q.r.Eval(context.TODO(), script, []string{
+		q.key("pending"),
+		q.key("items", soln.ContestId, soln.UserId),
+		q.key("users", soln.ContestId),
+		q.key("contests"),
+		q.key("pools"),
+	}, id, soln.ContestId, soln.UserId, q.poolOf(soln)).Err()
+}
+
+// contestWeights returns the weights of the contests and their total
+const contestWeights = `
+local function contestWeights(contests, weights)
+	local ws, total = {}, 0
+	for _, c in ipairs(redis.call('SMEMBERS', contests)) do
+		local w = tonumber(redis.call('HGET', weights, c)) or 1
+		if w < 1 then
+			w = 1
+		end
+		ws[c] = w
+		total = total + w
+	end
+	return ws, total
+end
+`
+
+// queueEntry is a queued solution found by Next
+type queueEntry struct {
+	ID      string
+	Contest string
+	User    string
+	// Empty if not limited
+	Pool string
+}
+
+// Next returns the solution to dispatch next, skipping those in the full
+// pools, or nil if there is none. It's only taken from the queue by Take.
+func (q *AdmissionQueue) Next(full map[string]bool) (*queueEntry, error) {
+	ctx := context.TODO()
+
+	// Contests in the order of smooth weighted round-robin
+	script := contestWeights + `
+	local ws = contestWeights(KEYS[1], KEYS[2])
+	local order = {}
+	for c, w in pairs(ws) do
+		order[#order + 1] = {c, (tonumber(redis.call('HGET', KEYS[3], c)) or 0) + w}
+	end
+	table.sort(order, function(a, b)
+		return a[2] > b[2] or (a[2] == b[2] and a[1] < b[1])
+	end)
+
+	local contests = {}
+	for i, c in ipairs(order) do
+		contests[i] = c[1]
+	end
+	return contests
+	`
+	contests, err := q.r.Eval(ctx, script, []string{
+		q.key("contests"), q.key("weights"), q.key("credits"),
+	}).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, contest := range contests {
+		entry, err := q.nextOfContest(contest, full)
+		if err != nil || entry != nil {
+			return entry, err
+		}
+	}
+	return nil, nil
+}
+
+// nextOfContest returns the first solution not in a full pool of the users
+// of the contest in turn
+func (q *AdmissionQueue) nextOfContest(contest string, full map[string]bool) (*queueEntry, error) {
+	ctx := context.TODO()
+
+	// The lists may be drained concurrently, or left over empty
+	users, err := q.r.LRange(ctx, q.key("users", contest), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, q.pruneContest(contest)
+	}
+
+	// The user at the tail is the next one
+	for i := len(users) - 1; i >= 0; i-- {
+		user := users[i]
+		ids, err := q.r.LRange(ctx, q.key("items", contest, user), 0, -1).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			err = q.pruneUser(contest, user)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		pools, err := q.r.HMGet(ctx, q.key("pools"), ids...).Result()
+		if err != nil {
+			return nil, err
+		}
+		for j, id := range ids {
+			pool, _ := pools[j].(string)
+			if full[pool] {
+				continue
+			}
+			return &queueEntry{ID: id, Contest: contest, User: user, Pool: pool}, nil
+		}
+	}
+	return nil, nil
+}
+
+// Take removes the solution found by Next and claims it for owner in the
+// same step, so that it's never seen unowned before it's locked. It returns
+// false if it's no longer queued.
+func (q *AdmissionQueue) Take(entry *queueEntry, owner string) (bool, error) {
+	script := contestWeights + `
+	local contests, weights, credits = KEYS[1], KEYS[2], KEYS[3]
+	local users, items, pending, pools, claim = KEYS[4], KEYS[5], KEYS[6], KEYS[7], KEYS[8]
+	local contest, user, id, owner, ttl = ARGV[1], ARGV[2], ARGV[3], ARGV[4], ARGV[5]
+
+	-- Taken or removed by someone else in the meantime
+	if redis.call('SISMEMBER', pending, id) == 0 or redis.call('LREM', items, 1, id) == 0 then
+		return 0
+	end
+
+	local ws, total = contestWeights(contests, weights)
+	for c, w in pairs(ws) do
+		redis.call('HINCRBY', credits, c, w)
+	end
+	redis.call('HINCRBY', credits, contest, -total)
+
+	-- The user goes last among the users of the contest
+	redis.call('LREM', users, 0, user)
+	if redis.call('LLEN', items) > 0 then
+		redis.call('LPUSH', users, user)
+	end
+	if redis.call('LLEN', users) == 0 then
+		redis.call('SREM', contests, contest)
+		redis.call('HDEL', credits, contest)
+	end
+
+	redis.call('SREM', pending, id)
+	redis.call('HDEL', pools, id)
+	redis.call('SET', claim, owner, 'PX', ttl)
+	return 1
+	`
+
+	res, err := q.r.Eval(context.TODO(), script, []string{
+		q.key("contests"), q.key("weights"), q.key("credits"),
+		q.key("users", entry.Contest), q.key("items", entry.Contest, entry.User),
+		q.key("pending"), q.key("pools"), claimKeyOf(entry.ID),
+	}, entry.Contest, entry.User, entry.ID, owner, claimTimeout.Milliseconds()).Int()
+	return res == 1, err
+}
+
+// pruneContest drops the contest if it has no queued users
+func (q *AdmissionQueue) pruneContest(contest string) error {
+	script := `
+	local users, contests, credits = KEYS[1], KEYS[2], KEYS[3]
+	local contest = ARGV[1]
+
+	if redis.call('LLEN', users) == 0 then
+		redis.call('SREM', contests, contest)
+		redis.call('HDEL', credits, contest)
+	end
+	return 0
+	`
+
+	return q.r.Eval(context.TODO(), script, []string{
+		q.key("users", contest), q.key("contests"), q.key("credits"),
+	}, contest).Err()
+}
+
+// pruneUser drops the user from the contest if it has no queued solutions
+func (q *AdmissionQueue) pruneUser(contest string, user string) error {
+	script := `
+	local items, users = KEYS[1], KEYS[2]
+	local user = ARGV[1]
+
+	if redis.call('LLEN', items) == 0 then
+		redis.call('LREM', users, 0, user)
+	end
+	return 0
+	`
+
+	return q.r.Eval(context.TODO(), script, []string{
+		q.key("items", contest, user), q.key("users", contest),
+	}, user).Err()
+}
+
+// Remove drops a queued solution, e.g. when it's cancelled
+func (q *AdmissionQueue) Remove(id string, soln *aoiclient.SolutionPoll) error {
+	script := `
+	local pending, items, users = KEYS[1], KEYS[2], KEYS[3]
+	local contests, credits, pools = KEYS[4], KEYS[5], KEYS[6]
+	local id, contest, user = ARGV[1], ARGV[2], ARGV[3]
+
+	if redis.call('SREM', pending, id) == 0 then
+		return 0
+	end
+
+	redis.call('HDEL', pools, id)
+	redis.call('LREM', items, 0, id)
+	if redis.call('LLEN', items) == 0 then
+		redis.call('LREM', users, 0, user)
+	end
+	if redis.call('LLEN', users) == 0 then
+		redis.call('SREM', contests, contest)
+		redis.call('HDEL', credits, contest)
+	end
+
+	return 1
+	`
+
+	return q.r.Eval(context.TODO(), script, []string{
+		q.key("pending"),
+		q.key("items", soln.ContestId, soln.UserId),
+		q.key("users", soln.ContestId),
+		q.key("contests"),
+		q.key("credits"),
+		q.key("pools"),
+	}, id, soln.ContestId, soln.UserId).Err()
+}
+
+func (q *AdmissionQueue) Len() (int64, error) {
+	return q.r.SCard(context.TODO(), q.key("pending")).Result()
+}
+
+func (q *AdmissionQueue) IsQueued(id string) (bool, error) {
+	return q.r.SIsMember(context.TODO(), q.key("pending"), id).Result()
+}
+
+// SetWeight sets the share of a contest relative to the others
+func (q *AdmissionQueue) SetWeight(contest string, weight int64) error {
+	return q.r.HSet(context.TODO(), q.key("weights"), contest, weight).Err()
+}
+
+type queueContestStats struct {
+	Weight int64            `json:"weight"`
+	Users  map[string]int64 `json:"users"`
+}
+
+// Stats returns the number of queued solutions of each user by contest
+func (q *AdmissionQueue) Stats() (map[string]*queueContestStats, error) {
+	ctx := context.TODO()
+
+	weights, err := q.r.HGetAll(ctx, q.key("weights")).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	contests, err := q.r.SMembers(ctx, q.key("contests")).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]*queueContestStats)
+	for _, c := range contests {
+		users, err := q.r.LRange(ctx, q.key("users", c), 0, -1).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		cs := &queueContestStats{Weight: 1, Users: make(map[string]int64)}
+		for _, u := range users {
+			n, err := q.r.LLen(ctx, q.key("items", c, u)).Result()
+			if err != nil {
+				return nil, err
+			}
+			cs.Users[u] = n
+		}
+		stats[c] = cs
+	}
+
+	for c, w := range weights {
+		cs, ok := stats[c]
+		if !ok {
+			cs = &queueContestStats{Users: make(map[string]int64)}
+			stats[c] = cs
+		}
+		cs.Weight, err = strconv.ParseInt(w, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,125 @@
+package manager
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/lcpu-club/hpcgame-judger/pkg/aoiclient"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestQueue(t *testing.T) *AdmissionQueue {
+	mr := miniredis.RunT(t)
+	r := &Redis{Client: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+	return NewAdmissionQueue(r, "queue", func(soln *aoiclient.SolutionPoll) string {
+		return soln.ProblemConfig.Label
+	})
+}
+
+func pushTestSolutions(t *testing.T, q *AdmissionQueue, solns ...[3]string) {
+	for _, s := range solns {
+		id, user, pool := s[0], s[1], s[2]
+		err := q.Push(id, &aoiclient.SolutionPoll{
+			ContestId:     "contest",
+			UserId:        user,
+			ProblemConfig: aoiclient.ProblemConfig{Label: pool},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// takeAll takes the solutions in the order they are dispatched
+func takeAll(t *testing.T, q *AdmissionQueue, full map[string]bool) []string {
+	var ids []string
+	for {
+		entry, err := q.Next(full)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil {
+			return ids
+		}
+
+		ok, err := q.Take(entry, "manager")
+		if err != nil || !ok {
+			t.Fatalf("failed to take %s: %v, %v", entry.ID, ok, err)
+		}
+		owner, err := q.r.Get(context.TODO(), claimKeyOf(entry.ID)).Result()
+		if err != nil || owner != "manager" {
+			t.Errorf("%s is claimed by %q, %v", entry.ID, owner, err)
+		}
+		ids = append(ids, entry.ID)
+	}
+}
+
+func TestQueueRoundRobinOverUsers(t *testing.T) {
+	q := newTestQueue(t)
+	pushTestSolutions(t, q,
+		[3]string{"a1", "a", ""},
+		[3]string{"a2", "a", ""},
+		[3]string{"a3", "a", ""},
+		[3]string{"b1", "b", ""},
+	)
+
+	got := takeAll(t, q, nil)
+	want := []string{"a1", "b1", "a2", "a3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("dispatched %v, want %v", got, want)
+	}
+
+	n, err := q.Len()
+	if err != nil || n != 0 {
+		t.Errorf("queue length is %d, %v", n, err)
+	}
+}
+
+func TestQueuePassesOverFullPools(t *testing.T) {
+	q := newTestQueue(t)
+	pushTestSolutions(t, q,
+		[3]string{"a1", "a", "gpu"},
+		[3]string{"a2", "a", ""},
+		[3]string{"a3", "a", "gpu"},
+		[3]string{"b1", "b", "gpu"},
+		[3]string{"b2", "b", "cpu"},
+	)
+
+	got := takeAll(t, q, map[string]bool{"gpu": true})
+	want := []string{"a2", "b2"}
+	if !slices.Equal(got, want) {
+		t.Errorf("dispatched %v while gpu is full, want %v", got, want)
+	}
+
+	// Passed over in place
+	got = takeAll(t, q, nil)
+	want = []string{"a1", "b1", "a3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("dispatched %v once gpu is free, want %v", got, want)
+	}
+}
+
+func TestQueueWeightedOverContests(t *testing.T) {
+	q := newTestQueue(t)
+	err := q.SetWeight("x", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []struct{ id, contest string }{
+		{"x1", "x"}, {"x2", "x"}, {"x3", "x"}, {"x4", "x"},
+		{"y1", "y"}, {"y2", "y"},
+	} {
+		err := q.Push(s.id, &aoiclient.SolutionPoll{ContestId: s.contest, UserId: "u"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := takeAll(t, q, nil)
+	want := []string{"x1", "y1", "x2", "x3", "y2", "x4"}
+	if !slices.Equal(got, want) {
+		t.Errorf("dispatched %v, want %v", got, want)
+	}
+}
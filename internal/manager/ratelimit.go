@@ -2,7 +2,20 @@ package manager
 
 import (
 	"context"
-	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lcpu-club/hpcgame-judger/internal/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+// Tokens are leases held in a sorted set under key, scored by their expiry
+// in Redis time. A lease is renewed while its session runs, so the tokens
+// of a dead manager are reclaimed once they expire.
+const (
+	leaseTTL           = time.Minute
+	leaseRenewInterval = 20 * time.Second
 )
 
 type RateLimiter struct {
@@ -10,14 +23,16 @@ type RateLimiter struct {
 
 	key      string
 	totalKey string
+	owner    string
 }
 
-func NewRateLimiter(r *Redis, key string, totalKey string) *RateLimiter {
+func NewRateLimiter(r *Redis, key string, totalKey string, owner string) *RateLimiter {
 	return &RateLimiter{
 		r: r,
 
 		key:      key,
 		totalKey: totalKey,
+		owner:    owner,
 	}
 }
 
@@ -31,53 +46,160 @@ func (rl *RateLimiter) Init(total int64) error {
 	return nil
 }
 
-func (rl *RateLimiter) Request() (bool, error) {
+// Lease is a rate limit token held by this manager
+type Lease struct {
+	rl *RateLimiter
+
+	ID string
+}
+
+// Request takes a token, it returns nil if none is available
+func (rl *RateLimiter) Request() (*Lease, error) {
 	script := `
-	local current = redis.call('GET', KEYS[1])
-	local total = redis.call('GET', KEYS[2])
+	local t = redis.call('TIME')
+	local now = t[1] * 1000 + math.floor(t[2] / 1000)
 
-	if current == false then
-		current = 0
-	end
+	redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
 
-	if tonumber(current) < tonumber(total) then
-		redis.call('INCR', KEYS[1])
+	local total = tonumber(redis.call('GET', KEYS[2]) or 0)
+	if redis.call('ZCARD', KEYS[1]) < total then
+		redis.call('ZADD', KEYS[1], now + tonumber(ARGV[2]), ARGV[1])
 		return 1
 	else
 		return 0
 	end
 	`
 
-	result, err := rl.r.Eval(context.TODO(), script, []string{rl.key, rl.totalKey}).Int64()
+	id := rl.owner + ":" + utils.GenerateRandomString(8, "")
+	result, err := rl.r.Eval(context.TODO(), script, []string{rl.key, rl.totalKey},
+		id, leaseTTL.Milliseconds()).Int64()
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	if result == 1 {
-		return true, nil
-	} else if result == 0 {
-		return false, nil
+	if result == 0 {
+		return nil, nil
 	}
 
-	return false, errors.New("unexpected result from Redis script")
+	return &Lease{rl: rl, ID: id}, nil
 }
 
-func (rl *RateLimiter) Release() error {
+// Renew extends the lease, it returns false if the lease is already lost
+func (l *Lease) Renew() (bool, error) {
 	script := `
-	local current = redis.call('GET', KEYS[1])
+	local t = redis.call('TIME')
+	local now = t[1] * 1000 + math.floor(t[2] / 1000)
 
-	if current == false or tonumber(current) <= 0 then
-		return false
-	else
-		redis.call('DECR', KEYS[1])
-		return true
+	if redis.call('ZSCORE', KEYS[1], ARGV[1]) == false then
+		return 0
 	end
+
+	redis.call('ZADD', KEYS[1], now + tonumber(ARGV[2]), ARGV[1])
+	return 1
 	`
 
-	_, err := rl.r.Eval(context.TODO(), script, []string{rl.key}).Result()
+	result, err := l.rl.r.Eval(context.TODO(), script, []string{l.rl.key},
+		l.ID, leaseTTL.Milliseconds()).Int64()
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	return nil
+	return result == 1, nil
+}
+
+func (l *Lease) Release() error {
+	return l.rl.r.ZRem(context.TODO(), l.rl.key, l.ID).Err()
+}
+
+// renewLeases keeps the leases until stop is closed, nil leases are skipped
+func renewLeases(leases []*Lease, stop <-chan struct{}) {
+	ticker := time.NewTicker(leaseRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		for _, l := range leases {
+			if l == nil {
+				continue
+			}
+
+			ok, err := l.Renew()
+			if err != nil {
+				log.Println("Failed to renew lease:", err)
+			} else if !ok {
+				log.Println("Lease", l.ID, "is lost")
+			}
+		}
+	}
+}
+
+// releaseLeases releases the leases, nil leases are skipped
+func releaseLeases(leases []*Lease) {
+	for _, l := range leases {
+		if l == nil {
+			continue
+		}
+
+		err := l.Release()
+		if err != nil {
+			log.Println("Failed to release lease:", err)
+		}
+	}
+}
+
+// Current returns the number of tokens in use
+func (rl *RateLimiter) Current() (int64, error) {
+	script := `
+	local t = redis.call('TIME')
+	local now = t[1] * 1000 + math.floor(t[2] / 1000)
+
+	return redis.call('ZCOUNT', KEYS[1], '(' .. now, '+inf')
+	`
+
+	return rl.r.Eval(context.TODO(), script, []string{rl.key}).Int64()
+}
+
+// Total returns the number of tokens available in total
+func (rl *RateLimiter) Total() (int64, error) {
+	v, err := rl.r.Get(context.TODO(), rl.totalKey).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return v, err
+}
+
+type leaseInfo struct {
+	ID      string    `json:"id"`
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// Holders lists the leases, including the expired ones not reclaimed yet
+func (rl *RateLimiter) Holders() ([]*leaseInfo, error) {
+	zs, err := rl.r.ZRangeWithScores(context.TODO(), rl.key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	holders := make([]*leaseInfo, 0, len(zs))
+	for _, z := range zs {
+		id, _ := z.Member.(string)
+		owner := id
+		if i := strings.LastIndex(id, ":"); i >= 0 {
+			owner = id[:i]
+		}
+
+		holders = append(holders, &leaseInfo{
+			ID:      id,
+			Owner:   owner,
+			Expires: time.UnixMilli(int64(z.Score)),
+		})
+	}
+
+	return holders, nil
 }
@@ -94,6 +94,15 @@ func (r *Redis) ReleaseLock(key string, value string) error {
 	}, key)
 }
 
+// GetLockOwner returns the value of the lock, or empty string if not locked
+func (r *Redis) GetLockOwner(key string) (string, error) {
+	v, err := r.Client.Get(context.Background(), key).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return v, err
+}
+
 func (r *Redis) IsLocked(key string) (bool, error) {
 	res, err := r.Client.Exists(context.Background(), key).Result()
 	if err != nil {
@@ -105,8 +114,13 @@ func (r *Redis) IsLocked(key string) (bool, error) {
 
 const solnKeyPrefix = "soln:"
 
+// solutionPollID returns the ID of the session judging soln
+func solutionPollID(soln *aoiclient.SolutionPoll) string {
+	return solnKeyPrefix + soln.SolutionId + ":" + soln.TaskId
+}
+
 func (r *Redis) StoreSolutionPoll(soln *aoiclient.SolutionPoll) (id string, err error) {
-	id = solnKeyPrefix + soln.SolutionId + ":" + soln.TaskId
+	id = solutionPollID(soln)
 	solnBytes, err := json.Marshal(soln)
 	if err != nil {
 		return "", err
@@ -138,3 +152,14 @@ func (r *Redis) DeleteSolutionPoll(id string) error {
 func (r *Redis) ListSolutionPoll() ([]string, error) {
 	return r.List(solnKeyPrefix)
 }
+
+const attemptsKeyPrefix = "judge:attempts:"
+
+// IncrAttempts counts a failed attempt of the session and returns the count
+func (r *Redis) IncrAttempts(id string) (int64, error) {
+	return r.Client.Incr(context.Background(), attemptsKeyPrefix+id).Result()
+}
+
+func (r *Redis) DeleteAttempts(id string) error {
+	return r.Client.Del(context.Background(), attemptsKeyPrefix+id).Err()
+}
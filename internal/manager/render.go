@@ -0,0 +1,54 @@
+package manager
+
+import (
+	"github.com/lcpu-club/hpcgame-judger/pkg/aoiclient"
+	batchv1 "k8s.io/api/batch/v1"
+)
+
+// RenderedSession is what a session submits to Kubernetes
+type RenderedSession struct {
+	Namespace string
+	// Objects rendered from the namespace templates
+	Objects []string
+	// Jobs of the stages in order
+	Jobs []*batchv1.Job
+}
+
+// RenderSession renders the objects of a session judging soln with rc,
+// which previews what's submitted without a cluster
+func RenderSession(ts *TemplateSet, rc *RunningConfig, soln *aoiclient.SolutionPoll, managerID string) (*RenderedSession, error) {
+	stages := rc.stages()
+	err := validateStages(stages)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := &RenderedSession{
+		Namespace: NamespaceOf(soln),
+	}
+
+	jc := NewJudgeContext(soln, rc, managerID)
+	rs.Objects, err = RenderNamespace(ts, rc, rs.Namespace, jc)
+	if err != nil {
+		return nil, err
+	}
+
+	sandbox, err := RenderSandbox(rc.Sandbox, rs.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	rs.Objects = append(rs.Objects, sandbox...)
+
+	for _, stage := range stages {
+		job, err := BuildJob(rs.Namespace, stage, jc, nil)
+		if err != nil {
+			return nil, err
+		}
+		job.APIVersion = batchv1.SchemeGroupVersion.String()
+		job.Kind = "Job"
+
+		rs.Jobs = append(rs.Jobs, job)
+	}
+
+	return rs, nil
+}
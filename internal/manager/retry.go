@@ -0,0 +1,28 @@
+package manager
+
+import "time"
+
+const maxRetryBackoff = 5 * time.Minute
+
+// shouldRetry counts a transient failure of the session, it returns the
+// attempt number if the session should be run again, or 0 if not
+func (m *Manager) shouldRetry(id string) (int64, error) {
+	attempt, err := m.r.IncrAttempts(id)
+	if err != nil {
+		return 0, err
+	}
+
+	if attempt >= *m.conf.MaxAttempts {
+		return 0, nil
+	}
+
+	return attempt, nil
+}
+
+func (m *Manager) retryBackoff(attempt int64) time.Duration {
+	backoff := *m.conf.RetryBackoff
+	for i := int64(1); i < attempt && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxRetryBackoff)
+}
@@ -2,19 +2,20 @@ package manager
 
 import (
 	"bufio"
-	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"strings"
 	"time"
 
+	"github.com/lcpu-club/hpcgame-judger/pkg/aoiclient"
+	"github.com/lcpu-club/hpcgame-judger/pkg/judgerproto"
 	"github.com/redis/go-redis/v9"
 	batchv1 "k8s.io/api/batch/v1"
-	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/watch"
-	"sigs.k8s.io/controller-runtime/pkg/client"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 const nsPrefix = "j-"
@@ -22,185 +23,326 @@ const nsPrefix = "j-"
 type RunningConfig struct {
 	JobTemplate *batchv1.Job           `json:"jobTemplate"`
 	Variables   map[string]interface{} `json:"variables"`
-}
 
-func (s *JudgeSession) run() error {
-	defer s.runningCleanup()
+	// TemplateSet names the extra namespace templates of the problem
+	TemplateSet string `json:"templateSet,omitempty"`
 
-	err := s.ensureNamespacePresence()
-	if err != nil {
-		return wrapError("ensureNamespacePresence", err)
-	}
+	// Container of JobTemplate speaking the protocol
+	Container string `json:"container,omitempty"`
 
-	err = s.ensureJobPresence()
-	if err != nil {
-		return wrapError("ensureJobPresence", err)
-	}
+	// Stages replaces JobTemplate with a pipeline of jobs run in order
+	Stages []*Stage `json:"stages,omitempty"`
 
-	return wrapError("watchJob", s.watchJob())
-}
+	// Overrides are applied in order to the job templates they select
+	Overrides []*JobOverride `json:"overrides,omitempty"`
 
-func (s *JudgeSession) GetNamespaceName() string {
-	return nsPrefix + s.soln.TaskId
-}
+	// StartTimeout limits the time until the judge is ready
+	StartTimeout Duration `json:"startTimeout,omitempty"`
+	// Deadline limits the wall-clock time of the whole session
+	Deadline Duration `json:"deadline,omitempty"`
+	// IdleTimeout limits the time between two lines of judge output
+	IdleTimeout Duration `json:"idleTimeout,omitempty"`
 
-func (s *JudgeSession) ensureNamespacePresence() error {
-	nsName := s.GetNamespaceName()
+	// Pool is the concurrency pool of the problem, defaults to the label
+	Pool string `json:"pool,omitempty"`
 
-	_, err := s.m.kc.Client().CoreV1().Namespaces().Get(context.TODO(), nsName, metav1.GetOptions{})
-	if err == nil {
-		return nil
-	}
-
-	err = s.createNamespace()
-	if err != nil {
-		return err
-	}
+	// QueueName is the Kueue LocalQueue the jobs are submitted to, the
+	// session timers are paused while they wait for quota
+	QueueName string `json:"queueName,omitempty"`
+	// QueueTimeout limits the total time the jobs wait for quota, unbounded
+	// if unset
+	QueueTimeout Duration `json:"queueTimeout,omitempty"`
 
-	return nil
+	// Sandbox tunes the baseline isolation of the namespace
+	Sandbox *SandboxConfig `json:"sandbox,omitempty"`
 }
 
-func (s *JudgeSession) createNamespace() error {
-	nsName := s.GetNamespaceName()
+const defaultStartTimeout = 20 * time.Minute
+
+// Stage is a step of the judge pipeline, e.g. compile, run or score, which
+// runs a job of its own in the session namespace
+type Stage struct {
+	// Name is also the name of the job
+	Name        string       `json:"name"`
+	JobTemplate *batchv1.Job `json:"jobTemplate"`
+	// Container speaks the protocol, see judgeContainerOf for the default
+	Container string `json:"container,omitempty"`
+
+	// Timeout limits the wall-clock time of the stage
+	Timeout Duration `json:"timeout,omitempty"`
+	// FailureStatus is reported if the job fails, defaults to Internal Error
+	FailureStatus string `json:"failureStatus,omitempty"`
+	// QueueName overrides RunningConfig.QueueName
+	QueueName string `json:"queueName,omitempty"`
+
+	// Overrides of RunningConfig applying to the stage
+	overrides []*JobOverride
+}
 
-	values := &struct {
-		Namespace string
-		Variables map[string]interface{}
-	}{
-		Namespace: nsName,
-		Variables: s.rc.Variables,
+// The job name of a session without stages
+const defaultStageName = "judge"
+
+// stages returns the pipeline of the session, a single stage running
+// JobTemplate if Stages is not set
+func (rc *RunningConfig) stages() []*Stage {
+	stages := rc.Stages
+	if len(stages) == 0 {
+		stages = []*Stage{{
+			Name:        defaultStageName,
+			JobTemplate: rc.JobTemplate,
+			Container:   rc.Container,
+		}}
+	}
+
+	result := make([]*Stage, 0, len(stages))
+	for _, s := range stages {
+		stage := *s
+		if stage.QueueName == "" {
+			stage.QueueName = rc.QueueName
+		}
+		stage.overrides = nil
+		for _, o := range rc.Overrides {
+			if o.appliesTo(stage.Name) {
+				stage.overrides = append(stage.overrides, o)
+			}
+		}
+		result = append(result, &stage)
 	}
+	return result
+}
 
-	for _, tmpl := range s.m.tmpls {
-		buf := bytes.NewBuffer(nil)
-		err := tmpl.Execute(buf, values)
-		if err != nil {
-			return err
+func validateStages(stages []*Stage) error {
+	names := make(map[string]bool)
+	for _, stage := range stages {
+		if errs := validation.IsDNS1123Label(stage.Name); len(errs) > 0 {
+			return fmt.Errorf("invalid stage name %q: %s", stage.Name, strings.Join(errs, ", "))
 		}
-
-		err = s.m.kc.Create(context.TODO(), buf.String(), false)
-
-		if err != nil {
-			return err
+		if names[stage.Name] {
+			return fmt.Errorf("duplicate stage name %q", stage.Name)
 		}
+		names[stage.Name] = true
 	}
-
-	log.Println("Created namespace", nsName)
-
 	return nil
 }
 
-const deleteNamespaceGracePeriods = 5
+// Duration is a time.Duration in JSON, written either as a string
+// like "1m30s" or as a number of seconds
+type Duration time.Duration
 
-func (s *JudgeSession) deleteNamespace() error {
-	err := s.m.kc.DeleteNamespace(context.TODO(), s.GetNamespaceName(), deleteNamespaceGracePeriods)
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	err := json.Unmarshal(b, &v)
 	if err != nil {
 		return err
 	}
 
-	log.Println("Deleted namespace", s.GetNamespaceName())
-
-	clusterRoleBindingName := fmt.Sprintf("%s-judge-binding", s.GetNamespaceName())
-	err = s.m.kc.Client().RbacV1().
-		ClusterRoleBindings().Delete(context.TODO(), clusterRoleBindingName, metav1.DeleteOptions{})
-	if client.IgnoreNotFound(err) != nil {
-		log.Println("Failed to delete cluster role binding:", err)
+	switch v := v.(type) {
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration: %s", b)
 	}
 
 	return nil
 }
 
-func (s *JudgeSession) GetJobName() string {
-	// HARDCODED NAME
-	return "judge"
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
 }
 
-func (s *JudgeSession) ensureJobPresence() error {
-	jobName := s.GetJobName()
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
 
-	_, err := s.m.kc.Client().BatchV1().Jobs(s.GetNamespaceName()).Get(context.TODO(), jobName, metav1.GetOptions{})
-	if err == nil {
-		return nil
+func (s *JudgeSession) run() error {
+	defer s.runningCleanup()
+
+	if d := s.rc.Deadline.Duration(); d > 0 {
+		deadline := s.startTimer(d, func() {
+			s.Stop(newStatusError(aoiclient.StatusTimeLimitExceeded, "Judging exceeded the deadline of %s", d))
+		})
+		defer s.stopTimer(deadline)
+	}
+	if d := s.rc.QueueTimeout.Duration(); d > 0 {
+		timeout := s.startQueueTimer(d, func() {
+			s.Stop(newStatusError(aoiclient.StatusError, "Judge jobs waited for quota longer than %s", d))
+		})
+		defer timeout.Stop()
 	}
 
-	err = s.createJob()
+	stages := s.rc.stages()
+	err := validateStages(stages)
 	if err != nil {
 		return err
 	}
 
-	log.Println("Created job", s.GetNamespaceName(), jobName)
+	err = s.prepareProblemData()
+	if err != nil {
+		return wrapError("prepareProblemData", err)
+	}
 
-	return nil
-}
+	err = s.m.exec.Provision(s.ctx, s)
+	if err != nil {
+		return wrapError("provision", err)
+	}
+	observeSince(metricNamespaceCreation, s.startedAt)
 
-func (s *JudgeSession) createJob() error {
-	if s.rc.JobTemplate == nil {
-		return fmt.Errorf("job template is nil")
+	// Resume from the stage running before the session is recovered
+	current, err := s.getStage()
+	if err != nil {
+		return wrapError("getStage", err)
 	}
 
-	job := s.rc.JobTemplate.DeepCopy()
-	job.Namespace = s.GetNamespaceName()
-	job.Name = s.GetJobName()
+	for i := current; i < len(stages); i++ {
+		err = s.runStage(stages[i], i == 0)
+		if err != nil {
+			return wrapError("stage "+stages[i].Name, err)
+		}
 
-	// Insert download environment variables
-	const varName = "SOLUTION_URL"
-	for k := range job.Spec.Template.Spec.Containers {
-		for _, env := range job.Spec.Template.Spec.Containers[k].Env {
-			if env.Name == varName {
-				// Unset if exists
-				job.Spec.Template.Spec.Containers[k].Env = append(job.Spec.Template.Spec.Containers[k].Env[:k], job.Spec.Template.Spec.Containers[k].Env[k+1:]...)
-				break
+		// The judge asked to end the session early
+		if s.quit {
+			break
+		}
+
+		if i+1 < len(stages) {
+			err = s.setStage(i + 1)
+			if err != nil {
+				return wrapError("setStage", err)
+			}
+			// Output of the next stage starts over
+			err = s.deleteProcessedTimestamp()
+			if err != nil {
+				return wrapError("deleteProcessedTimestamp", err)
 			}
 		}
+	}
 
-		job.Spec.Template.Spec.Containers[k].Env = append(job.Spec.Template.Spec.Containers[k].Env, corev1.EnvVar{
-			Name:  varName,
-			Value: s.soln.SolutionDataUrl,
-		})
+	// MUST complete the job, otherwise maybe not completed
+	if !s.completed {
+		err = observeAOIError(s.aoi.Complete(context.TODO()))
+		if err != nil {
+			log.Println("Failed to complete solution:", err)
+		}
 	}
 
-	_, err := s.m.kc.Client().BatchV1().Jobs(s.GetNamespaceName()).Create(context.TODO(), job, metav1.CreateOptions{})
-	return err
+	return nil
 }
 
-func (s *JudgeSession) getPodLogsOfJob(follow bool, since *time.Time) (io.ReadCloser, error) {
-	jobName := s.GetJobName()
+func (s *JudgeSession) runStage(stage *Stage, first bool) error {
+	s.stage = stage.Name
 
-	pods, err := s.m.kc.Client().CoreV1().Pods(s.GetNamespaceName()).List(context.TODO(), metav1.ListOptions{
-		LabelSelector: fmt.Sprintf("job-name=%s", jobName),
-	})
+	if d := stage.Timeout.Duration(); d > 0 {
+		timeout := s.startTimer(d, func() {
+			s.Stop(newStatusError(aoiclient.StatusTimeLimitExceeded, "Stage %s exceeded the time limit of %s", stage.Name, d))
+		})
+		defer s.stopTimer(timeout)
+	}
+
+	err := s.m.exec.Start(s.ctx, s, stage)
 	if err != nil {
-		return nil, err
+		return wrapError("start", err)
 	}
 
-	if len(pods.Items) == 0 {
-		return nil, nil
+	monitorCtx, stopMonitor := context.WithCancel(s.ctx)
+	defer stopMonitor()
+	go func() {
+		err := s.m.exec.Monitor(monitorCtx, s, stage)
+		if err != nil {
+			s.Stop(err)
+		}
+	}()
+
+	err = s.watchJob(stage, first)
+	if err != nil {
+		return wrapError("watchJob", err)
 	}
 
-	podName := pods.Items[0].Name
+	// Without stages, the judge reports the result by itself
+	if s.quit || len(s.rc.Stages) == 0 {
+		return nil
+	}
 
-	opts := &corev1.PodLogOptions{
-		Follow: follow,
+	ok, err := s.m.exec.Finish(s.ctx, s, stage)
+	if err != nil {
+		return wrapError("finish", err)
 	}
-	if since != nil {
-		opts.SinceTime = &metav1.Time{Time: *since}
+
+	if !ok {
+		status := stage.FailureStatus
+		if status == "" {
+			status = aoiclient.StatusInternalError
+		}
+		return newStatusError(status, "Stage %s failed", stage.Name)
 	}
-	logReq := s.m.kc.Client().CoreV1().Pods(s.GetNamespaceName()).GetLogs(podName, opts)
-	reader, err := logReq.Stream(context.TODO())
 
-	return reader, err
+	return nil
+}
+
+func (s *JudgeSession) GetNamespaceName() string {
+	return NamespaceOf(s.soln)
+}
+
+// judgeContext returns what the judge is told about the session
+func (s *JudgeSession) judgeContext() *JudgeContext {
+	return NewJudgeContext(s.soln, s.rc, s.m.ID())
+}
+
+// NamespaceOf returns the namespace of the session judging soln
+func NamespaceOf(soln *aoiclient.SolutionPoll) string {
+	return nsPrefix + soln.TaskId
 }
 
-func (s *JudgeSession) processedTimestampKey() string {
-	return fmt.Sprintf("judge:processed:%s", s.id)
+func (s *JudgeSession) teardown() error {
+	return s.m.exec.Teardown(context.TODO(), s)
 }
 
-func (s *JudgeSession) updateProcessedTimestamp(t *time.Time) error {
-	return s.m.r.Client.Set(context.TODO(), s.processedTimestampKey(), t.Format(time.RFC3339), 0).Err()
+func processedTimestampKey(id string) string {
+	return fmt.Sprintf("judge:processed:%s", id)
+}
+
+// lastSeqKey is a hash of the last applied sequence number of each judge
+// instance, since every judge process numbers its messages from 1
+func lastSeqKey(id string) string {
+	return fmt.Sprintf("judge:seq:%s", id)
+}
+
+// updateProcessed records the progress after a message of the instance is
+// applied, seq is 0 if the judge doesn't number its messages
+func (s *JudgeSession) updateProcessed(t *time.Time, instance string, seq uint64) error {
+	_, err := s.m.r.Client.TxPipelined(context.TODO(), func(pipe redis.Pipeliner) error {
+		pipe.Set(context.TODO(), processedTimestampKey(s.id), t.Format(time.RFC3339), 0)
+		if seq > 0 {
+			pipe.HSet(context.TODO(), lastSeqKey(s.id), instance, seq)
+		} else {
+			pipe.HSetNX(context.TODO(), lastSeqKey(s.id), instance, 0)
+		}
+		return nil
+	})
+	return err
+}
+
+// getLastSeq returns the sequence number of the last applied message of the
+// instance, and whether any of its messages is applied
+func (s *JudgeSession) getLastSeq(instance string) (uint64, bool, error) {
+	seq, err := s.m.r.Client.HGet(context.TODO(), lastSeqKey(s.id), instance).Uint64()
+	if err == redis.Nil {
+		return 0, false, nil
+	}
+	return seq, err == nil, err
 }
 
 func (s *JudgeSession) getProcessedTimestamp() (*time.Time, error) {
-	t, err := s.m.r.Client.Get(context.TODO(), s.processedTimestampKey()).Result()
+	return s.m.getProcessedTimestamp(s.id)
+}
+
+func (m *Manager) getProcessedTimestamp(id string) (*time.Time, error) {
+	t, err := m.r.Client.Get(context.TODO(), processedTimestampKey(id)).Result()
 
 	// If not exist, return nil, nil
 	if err == redis.Nil {
@@ -218,126 +360,137 @@ func (s *JudgeSession) getProcessedTimestamp() (*time.Time, error) {
 	return &parsed, nil
 }
 
+func stageKey(id string) string {
+	return fmt.Sprintf("judge:stage:%s", id)
+}
+
+// getStage returns the index of the current stage
+func (s *JudgeSession) getStage() (int, error) {
+	i, err := s.m.r.Client.Get(context.TODO(), stageKey(s.id)).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return i, err
+}
+
+func (s *JudgeSession) setStage(i int) error {
+	return s.m.r.Client.Set(context.TODO(), stageKey(s.id), i, 0).Err()
+}
+
+func (m *Manager) deleteStage(id string) error {
+	return m.r.Client.Del(context.TODO(), stageKey(id)).Err()
+}
+
 func (s *JudgeSession) deleteProcessedTimestamp() error {
-	return s.m.r.Client.Del(context.TODO(), s.processedTimestampKey()).Err()
+	return s.m.deleteProcessedTimestamp(s.id)
+}
+
+// deleteProcessedTimestamp also drops the last applied sequence number
+func (m *Manager) deleteProcessedTimestamp(id string) error {
+	return m.r.Client.Del(context.TODO(), processedTimestampKey(id), lastSeqKey(id)).Err()
 }
 
 func (s *JudgeSession) runningCleanup() {
+	// The workload keeps running for the manager taking it over
+	if errors.Is(context.Cause(s.ctx), errSessionHandedOff) {
+		return
+	}
+
 	err := s.deleteProcessedTimestamp()
 	if err != nil {
 		log.Println("Failed to delete processed timestamp:", err)
 	}
-	err = s.deleteNamespace()
+	err = s.m.deleteStage(s.id)
 	if err != nil {
-		log.Println("Failed to delete namespace:", err)
+		log.Println("Failed to delete stage:", err)
 	}
-}
-
-func calcReadyAndFinishedPods(job batchv1.JobStatus) int {
-	ready := 0
-	if job.Ready != nil {
-		ready = int(*job.Ready)
-	}
-	// active := int(job.Active)
-	finished := int(job.Succeeded + job.Failed)
-	terminating := 0
-	if job.Terminating != nil {
-		terminating = int(*job.Terminating)
+	err = s.teardown()
+	if err != nil {
+		log.Println("Failed to teardown:", err)
 	}
-	return ready + finished + terminating
 }
 
-const watchJobTimeout = 20 * time.Minute
-
-func (s *JudgeSession) watchJobTillReady() error {
-	jobName := s.GetJobName()
-
-	watcher, err := s.m.kc.Client().BatchV1().Jobs(s.GetNamespaceName()).Watch(context.TODO(), metav1.ListOptions{
-		FieldSelector: fmt.Sprintf("metadata.name=%s", jobName),
-	})
-	if err != nil {
-		return err
+func (s *JudgeSession) watchJob(stage *Stage, first bool) error {
+	startTimeout := s.rc.StartTimeout.Duration()
+	if startTimeout <= 0 {
+		startTimeout = defaultStartTimeout
 	}
-	defer watcher.Stop()
+	timer := s.startTimer(startTimeout, func() {
+		s.Stop(newStatusError(aoiclient.StatusInternalError, "Judge did not start within %s", startTimeout))
+	})
 
-	// Check for status, in case it's already running
-	job, err := s.m.kc.Client().BatchV1().Jobs(s.GetNamespaceName()).Get(context.TODO(), jobName, metav1.GetOptions{})
+	err := s.m.exec.WaitReady(s.ctx, s, stage)
+	s.stopTimer(timer)
+	s.setQueued(false, "")
 	if err != nil {
-		return err
-	}
-	if job.Status.Active > 0 {
-		if job.Status.Ready != nil && *job.Status.Ready > 0 {
-			return nil
-		}
+		return wrapError("waitReady", err)
 	}
-	if job.Status.Succeeded > 0 || job.Status.Failed > 0 {
-		return nil
-	}
-	if calcReadyAndFinishedPods(job.Status) > 0 {
-		return nil
+	if first {
+		observeSince(metricJobReady, s.startedAt)
 	}
-	log.Println("Job not ready yet", s.GetNamespaceName())
 
-	// Wait for the job to start running
-	for {
-		select {
-		case event, ok := <-watcher.ResultChan():
-			if !ok {
-				return fmt.Errorf("watcher channel closed unexpectedly")
-			}
+	log.Println("Job started running", s.GetNamespaceName(), stage.Name)
 
-			job, ok := event.Object.(*batchv1.Job)
-			if !ok {
-				continue
-			}
-
-			// Check if the job has started running
-			if job.Status.Active > 0 {
-				if job.Status.Ready != nil && *job.Status.Ready > 0 {
-					return nil
-				}
-			}
-			if job.Status.Succeeded > 0 || job.Status.Failed > 0 {
-				return nil
-			}
-
-			if event.Type != watch.Added && event.Type != watch.Modified {
-				return fmt.Errorf("job not running: %s", job.Status.String())
-			}
-		case <-time.After(watchJobTimeout):
-			return fmt.Errorf("timed out waiting for job %s to be ready", job)
-		}
-	}
+	// Start the log pulling loop
+	return wrapError("pullJobLogs", s.pullJobLogs(stage))
 }
 
-func (s *JudgeSession) watchJob() error {
-	err := s.watchJobTillReady()
-	if err != nil {
-		return wrapError("waitJobTillReady", err)
+// resumePoint returns where to continue reading the output of the instance,
+// nil if it's read from the start. That is when none of its output is
+// applied yet, or when its messages are numbered and the applied ones can be
+// skipped exactly. Otherwise it's the time the last applied message was
+// printed, which may be applied again.
+func (s *JudgeSession) resumePoint(instance string) (*time.Time, error) {
+	lastSeq, found, err := s.getLastSeq(instance)
+	if err != nil || !found || lastSeq > 0 {
+		return nil, wrapError("getLastSeq", err)
 	}
 
-	log.Println("Job started running", s.GetNamespaceName())
-
-	// Get the timestamp before starting the log pulling loop
 	since, err := s.getProcessedTimestamp()
 	if err != nil {
-		return wrapError("getProcessedTimestamp", err)
+		return nil, wrapError("getProcessedTimestamp", err)
 	}
+	return since, nil
+}
 
-	// Start the log pulling loop
-	return wrapError("pullJobLogs", s.pullJobLogs(since))
+// instanceReader is implemented by streams which tell which process of the
+// judge printed the output read last. Read never returns the output of two
+// instances at once, so it's the instance of the line just read.
+type instanceReader interface {
+	Instance() string
 }
 
-func (s *JudgeSession) pullJobLogs(since *time.Time) error {
-	reader, err := s.getPodLogsOfJob(true, since)
+// pullJobLogs applies the protocol messages of the stage. Every process of
+// the judge numbers its messages from 1, those up to the last applied one of
+// the same instance are skipped.
+func (s *JudgeSession) pullJobLogs(stage *Stage) error {
+	reader, err := s.m.exec.Stream(s.ctx, s, stage)
 	if err != nil {
-		return wrapError("getPodLogsOfJob", err)
+		return wrapError("stream", err)
 	}
 	defer reader.Close()
 
+	// Stopping the session also aborts the blocking read
+	var watchdog *time.Timer
+	idleTimeout := s.rc.IdleTimeout.Duration()
+	if idleTimeout > 0 {
+		watchdog = time.AfterFunc(idleTimeout, func() {
+			s.Stop(newStatusError(aoiclient.StatusTimeLimitExceeded, "Judge produced no output for %s", idleTimeout))
+		})
+		defer watchdog.Stop()
+	}
+
+	ir, _ := reader.(instanceReader)
+	var instance string
+	var lastSeq uint64
+	loaded := false
+
 	buf := bufio.NewReader(reader)
 	for {
 		line, err := buf.ReadBytes('\n')
+		if watchdog != nil {
+			watchdog.Reset(idleTimeout)
+		}
 		if err != nil {
 			if err == io.EOF {
 				break
@@ -350,22 +503,49 @@ func (s *JudgeSession) pullJobLogs(since *time.Time) error {
 		}
 
 		// Process each line as an action
-		// TODO: real processing logic
 		log.Printf("Action: %s", lineStr)
-		err = s.processMessage(lineStr)
+		msg, err := judgerproto.MessageFromString(lineStr)
+		if err != nil {
+			return wrapError("parseMessage", err)
+		}
+
+		// A new process of the judge numbers its messages again
+		cur := ""
+		if ir != nil {
+			cur = ir.Instance()
+		}
+		if !loaded || cur != instance {
+			instance = cur
+			lastSeq, _, err = s.getLastSeq(instance)
+			if err != nil {
+				return wrapError("getLastSeq", err)
+			}
+			loaded = true
+		}
+
+		if msg.Seq > 0 && msg.Seq <= lastSeq {
+			log.Println("Skipped applied message", msg.Seq, "of", s.GetNamespaceName())
+			continue
+		}
+
+		err = s.processMessage(msg)
 		if err != nil {
 			return wrapError("processMessage", err)
 		}
 
-		// Update the processed timestamp
-		now := time.Now()
-		if err := s.updateProcessedTimestamp(&now); err != nil {
-			return wrapError("updateProcessedTimestamp", err)
+		if msg.Seq > lastSeq {
+			lastSeq = msg.Seq
 		}
-	}
 
-	// MUST complete the job, otherwise maybe not completed
-	s.aoi.Complete(context.TODO())
+		// The time the message was printed, the manager may lag behind
+		printed := msg.Time
+		if printed.IsZero() {
+			printed = time.Now()
+		}
+		if err := s.updateProcessed(&printed, instance, msg.Seq); err != nil {
+			return wrapError("updateProcessed", err)
+		}
+	}
 
 	return nil
 }
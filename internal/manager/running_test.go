@@ -0,0 +1,220 @@
+package manager
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/lcpu-club/hpcgame-judger/pkg/aoiclient"
+	"github.com/lcpu-club/hpcgame-judger/pkg/judgerproto"
+	"github.com/redis/go-redis/v9"
+)
+
+// scriptedOutput is the output of a judge container, one instance after
+// another, e.g. a container and the one it's restarted as
+type scriptedOutput struct {
+	instances []string
+	outputs   []string
+
+	cur *strings.Reader
+}
+
+func (o *scriptedOutput) Read(p []byte) (int, error) {
+	for o.cur == nil || o.cur.Len() == 0 {
+		if len(o.outputs) == 0 {
+			return 0, io.EOF
+		}
+		if o.cur != nil {
+			o.instances = o.instances[1:]
+		}
+		o.cur = strings.NewReader(o.outputs[0])
+		o.outputs = o.outputs[1:]
+	}
+	return o.cur.Read(p)
+}
+
+func (o *scriptedOutput) Instance() string {
+	return o.instances[0]
+}
+
+func (o *scriptedOutput) Close() error {
+	return nil
+}
+
+// kubeletLog is the output of a judge container as kept by the kubelet,
+// which is read since the resume point like pod logs are
+type kubeletLog struct {
+	Executor
+	instance string
+	msgs     []*judgerproto.Message
+	// Lines read before the stream breaks, all of them if 0
+	limit int
+}
+
+func (e *kubeletLog) Stream(ctx context.Context, s *JudgeSession, stage *Stage) (io.ReadCloser, error) {
+	since, err := s.resumePoint(e.instance)
+	if err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, m := range e.msgs {
+		// SinceTime is in seconds
+		if since != nil && m.Time.Before(since.Truncate(time.Second)) {
+			continue
+		}
+		if e.limit > 0 && n == e.limit {
+			break
+		}
+		b.WriteString(m.String() + "\n")
+		n++
+	}
+
+	return &scriptedOutput{
+		instances: []string{e.instance},
+		outputs:   []string{b.String()},
+	}, nil
+}
+
+type scriptedExecutor struct {
+	Executor
+	output *scriptedOutput
+}
+
+func (e *scriptedExecutor) Stream(ctx context.Context, s *JudgeSession, stage *Stage) (io.ReadCloser, error) {
+	return e.output, nil
+}
+
+func logLines(seqs []uint64, msgs []string) string {
+	var b strings.Builder
+	for i, msg := range msgs {
+		m := judgerproto.NewLogMessage(msg)
+		m.Seq = seqs[i]
+		b.WriteString(m.String() + "\n")
+	}
+	return b.String()
+}
+
+func newTestSession(t *testing.T, exec Executor) *JudgeSession {
+	mr := miniredis.RunT(t)
+	m := &Manager{
+		exec: exec,
+		r:    &Redis{Client: redis.NewClient(&redis.Options{Addr: mr.Addr()})},
+	}
+	return &JudgeSession{
+		id:   "soln:s:t",
+		m:    m,
+		ctx:  context.Background(),
+		rc:   &RunningConfig{},
+		soln: &aoiclient.SolutionPoll{SolutionId: "s", TaskId: "t"},
+	}
+}
+
+func appliedLogs(t *testing.T, s *JudgeSession) []string {
+	msgs, err := s.m.r.XRange(context.TODO(), logStreamKey(s.id), "-", "+").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs []string
+	for _, msg := range msgs {
+		logs = append(logs, msg.Values["msg"].(string))
+	}
+	return logs
+}
+
+func TestPullJobLogsAfterContainerRestart(t *testing.T) {
+	exec := &scriptedExecutor{output: &scriptedOutput{
+		instances: []string{"pod/0", "pod/1"},
+		outputs: []string{
+			logLines([]uint64{1, 2, 3}, []string{"a1", "a2", "a3"}),
+			// Restarted, the messages are numbered from 1 again
+			logLines([]uint64{1, 2}, []string{"b1", "b2"}),
+		},
+	}}
+	s := newTestSession(t, exec)
+
+	err := s.pullJobLogs(&Stage{Name: "judge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := strings.Join(appliedLogs(t, s), ",")
+	if got != "a1,a2,a3,b1,b2" {
+		t.Errorf("applied %s, want a1,a2,a3,b1,b2", got)
+	}
+
+	// Every instance keeps its own progress
+	for instance, want := range map[string]uint64{"pod/0": 3, "pod/1": 2} {
+		seq, found, err := s.getLastSeq(instance)
+		if err != nil || !found || seq != want {
+			t.Errorf("last seq of %s is %d, %v, %v, want %d", instance, seq, found, err, want)
+		}
+	}
+}
+
+func TestPullJobLogsSkipsApplied(t *testing.T) {
+	exec := &scriptedExecutor{output: &scriptedOutput{
+		instances: []string{"pod/0"},
+		outputs:   []string{logLines([]uint64{1, 2}, []string{"a1", "a2"})},
+	}}
+	s := newTestSession(t, exec)
+
+	err := s.pullJobLogs(&Stage{Name: "judge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read again from a second before the last applied message
+	exec.output = &scriptedOutput{
+		instances: []string{"pod/0", "pod/1"},
+		outputs: []string{
+			logLines([]uint64{2, 3}, []string{"a2", "a3"}),
+			logLines([]uint64{1}, []string{"b1"}),
+		},
+	}
+	err = s.pullJobLogs(&Stage{Name: "judge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := strings.Join(appliedLogs(t, s), ",")
+	if got != "a1,a2,a3,b1" {
+		t.Errorf("applied %s, want a1,a2,a3,b1", got)
+	}
+}
+
+func TestPullJobLogsLaggingBehindJudge(t *testing.T) {
+	// Printed a while before the manager gets to apply them
+	printed := time.Now().Add(-time.Minute)
+	var msgs []*judgerproto.Message
+	for i, log := range []string{"a1", "a2", "a3"} {
+		m := judgerproto.NewLogMessage(log)
+		m.Time = printed.Add(time.Duration(i) * 100 * time.Millisecond)
+		m.Seq = uint64(i + 1)
+		msgs = append(msgs, m)
+	}
+
+	// The manager crashes after applying the first message
+	exec := &kubeletLog{instance: "pod/0", msgs: msgs, limit: 1}
+	s := newTestSession(t, exec)
+
+	err := s.pullJobLogs(&Stage{Name: "judge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exec.limit = 0
+	err = s.pullJobLogs(&Stage{Name: "judge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := strings.Join(appliedLogs(t, s), ",")
+	if got != "a1,a2,a3" {
+		t.Errorf("applied %s, want a1,a2,a3", got)
+	}
+}
@@ -0,0 +1,227 @@
+package manager
+
+import (
+	"fmt"
+	"maps"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/yaml"
+)
+
+// Every judge namespace gets a baseline sandbox on top of its templates, so
+// that isolation doesn't depend on the templates remembering it
+const (
+	sandboxName = "sandbox"
+
+	// Judge pods are those of the stage jobs, the rest run user code
+	roleLabel = contextKeyPrefix + "role"
+	roleJudge = "judge"
+
+	judgePort = 23456
+
+	podSecurityEnforceLabel = "pod-security.kubernetes.io/enforce"
+	podSecurityWarnLabel    = "pod-security.kubernetes.io/warn"
+	podSecurityAuditLabel   = "pod-security.kubernetes.io/audit"
+)
+
+// SandboxConfig tunes the baseline sandbox of the judge namespaces, unset
+// fields keep the defaults
+type SandboxConfig struct {
+	// Disabled leaves the isolation to the namespace templates
+	Disabled bool `json:"disabled,omitempty"`
+
+	// Quota is merged into the hard limits of the ResourceQuota
+	Quota corev1.ResourceList `json:"quota,omitempty"`
+	// DefaultLimits and DefaultRequests are merged into the defaults of the
+	// LimitRange, given to containers which don't set them
+	DefaultLimits   corev1.ResourceList `json:"defaultLimits,omitempty"`
+	DefaultRequests corev1.ResourceList `json:"defaultRequests,omitempty"`
+
+	// PodSecurity is the enforced Pod Security Standard level, baseline if
+	// empty
+	PodSecurity string `json:"podSecurity,omitempty"`
+	// AllowEgress lets user pods connect outside of the namespace, judge
+	// pods always can, e.g. to download the solution
+	AllowEgress bool `json:"allowEgress,omitempty"`
+	// AutomountServiceAccountToken mounts the token of the default service
+	// account, which user pods run as
+	AutomountServiceAccountToken bool `json:"automountServiceAccountToken,omitempty"`
+}
+
+var (
+	defaultSandboxQuota = corev1.ResourceList{
+		corev1.ResourcePods:                   resource.MustParse("64"),
+		corev1.ResourceRequestsCPU:            resource.MustParse("16"),
+		corev1.ResourceRequestsMemory:         resource.MustParse("32Gi"),
+		corev1.ResourceLimitsCPU:              resource.MustParse("32"),
+		corev1.ResourceLimitsMemory:           resource.MustParse("64Gi"),
+		corev1.ResourceServicesLoadBalancers:  resource.MustParse("0"),
+		corev1.ResourceServicesNodePorts:      resource.MustParse("0"),
+		corev1.ResourcePersistentVolumeClaims: resource.MustParse("8"),
+	}
+	defaultSandboxLimits = corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("1"),
+		corev1.ResourceMemory: resource.MustParse("1Gi"),
+	}
+	defaultSandboxRequests = corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("100m"),
+		corev1.ResourceMemory: resource.MustParse("128Mi"),
+	}
+)
+
+const defaultPodSecurity = "baseline"
+
+func (c *SandboxConfig) disabled() bool {
+	return c != nil && c.Disabled
+}
+
+func (c *SandboxConfig) podSecurity() (string, error) {
+	if c == nil || c.PodSecurity == "" {
+		return defaultPodSecurity, nil
+	}
+
+	switch c.PodSecurity {
+	case "privileged", "baseline", "restricted":
+		return c.PodSecurity, nil
+	}
+	return "", fmt.Errorf("invalid pod security level: %s", c.PodSecurity)
+}
+
+// sandboxLabels returns the labels of the namespace
+func sandboxLabels(c *SandboxConfig) (map[string]string, error) {
+	if c.disabled() {
+		return nil, nil
+	}
+
+	level, err := c.podSecurity()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		podSecurityEnforceLabel: level,
+		podSecurityWarnLabel:    level,
+		podSecurityAuditLabel:   level,
+	}, nil
+}
+
+func mergeResources(base corev1.ResourceList, override corev1.ResourceList) corev1.ResourceList {
+	result := maps.Clone(base)
+	maps.Copy(result, override)
+	return result
+}
+
+// RenderSandbox returns the sandbox objects of the namespace, which are
+// applied after the templates
+func RenderSandbox(c *SandboxConfig, namespace string) ([]string, error) {
+	if c.disabled() {
+		return nil, nil
+	}
+	if c == nil {
+		c = &SandboxConfig{}
+	}
+
+	meta := metav1.ObjectMeta{
+		Name:      sandboxName,
+		Namespace: namespace,
+	}
+
+	quota := &corev1.ResourceQuota{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ResourceQuota"},
+		ObjectMeta: meta,
+		Spec: corev1.ResourceQuotaSpec{
+			Hard: mergeResources(defaultSandboxQuota, c.Quota),
+		},
+	}
+
+	limits := &corev1.LimitRange{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "LimitRange"},
+		ObjectMeta: meta,
+		Spec: corev1.LimitRangeSpec{
+			Limits: []corev1.LimitRangeItem{{
+				Type:           corev1.LimitTypeContainer,
+				Default:        mergeResources(defaultSandboxLimits, c.DefaultLimits),
+				DefaultRequest: mergeResources(defaultSandboxRequests, c.DefaultRequests),
+			}},
+		},
+	}
+
+	// User code runs as the default service account
+	sa := &corev1.ServiceAccount{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "default",
+			Namespace: namespace,
+		},
+		AutomountServiceAccountToken: ptr.To(c.AutomountServiceAccountToken),
+	}
+
+	objs := []interface{}{quota, limits, sa}
+	objs = append(objs, sandboxNetworkPolicies(c, namespace)...)
+
+	var docs []string
+	for _, obj := range objs {
+		b, err := yaml.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, string(b))
+	}
+	return docs, nil
+}
+
+// sandboxNetworkPolicies denies all traffic but within the namespace, to
+// the judge port, and from the judge pods
+func sandboxNetworkPolicies(c *SandboxConfig, namespace string) []interface{} {
+	policy := func(name string, spec networkingv1.NetworkPolicySpec) *networkingv1.NetworkPolicy {
+		return &networkingv1.NetworkPolicy{
+			TypeMeta: metav1.TypeMeta{APIVersion: "networking.k8s.io/v1", Kind: "NetworkPolicy"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+			},
+			Spec: spec,
+		}
+	}
+	bothTypes := []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress}
+	samePods := []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{}}}
+	judgePods := metav1.LabelSelector{MatchLabels: map[string]string{roleLabel: roleJudge}}
+
+	dnsPorts := []networkingv1.NetworkPolicyPort{
+		{Protocol: ptr.To(corev1.ProtocolUDP), Port: ptr.To(intstr.FromInt32(53))},
+		{Protocol: ptr.To(corev1.ProtocolTCP), Port: ptr.To(intstr.FromInt32(53))},
+	}
+	egress := []networkingv1.NetworkPolicyEgressRule{
+		{To: samePods},
+		{Ports: dnsPorts},
+	}
+	if c.AllowEgress {
+		egress = []networkingv1.NetworkPolicyEgressRule{{}}
+	}
+
+	return []interface{}{
+		policy(sandboxName+"-default-deny", networkingv1.NetworkPolicySpec{
+			PolicyTypes: bothTypes,
+		}),
+		policy(sandboxName+"-namespace", networkingv1.NetworkPolicySpec{
+			PolicyTypes: bothTypes,
+			Ingress:     []networkingv1.NetworkPolicyIngressRule{{From: samePods}},
+			Egress:      egress,
+		}),
+		policy(sandboxName+"-judge", networkingv1.NetworkPolicySpec{
+			PodSelector: judgePods,
+			PolicyTypes: bothTypes,
+			Ingress: []networkingv1.NetworkPolicyIngressRule{{
+				Ports: []networkingv1.NetworkPolicyPort{{
+					Protocol: ptr.To(corev1.ProtocolTCP),
+					Port:     ptr.To(intstr.FromInt32(judgePort)),
+				}},
+			}},
+			Egress: []networkingv1.NetworkPolicyEgressRule{{}},
+		}),
+	}
+}
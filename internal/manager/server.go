@@ -0,0 +1,40 @@
+package manager
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func (m *Manager) serveAPI() {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	m.registerAdminAPI(mux)
+
+	srv := &http.Server{
+		Addr:    *m.conf.Listen,
+		Handler: mux,
+	}
+
+	log.Println("Serving API on", *m.conf.Listen)
+
+	var err error
+	if *m.conf.TLSCertFile != "" && *m.conf.TLSKeyFile != "" {
+		err = srv.ListenAndServeTLS(*m.conf.TLSCertFile, *m.conf.TLSKeyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	log.Println("API server stopped:", err)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println("Failed to write response:", err)
+	}
+}
@@ -1,9 +1,12 @@
 package manager
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -14,6 +17,17 @@ const judgeSessionLockKeyPrefix = "judge:lock:"
 const judgeSessionLockTimeout = 6 * 60 * time.Second
 const judgeSessionUpdateInterval = 2 * 60 * time.Second
 
+var (
+	errSessionCancelled = errors.New("judge session cancelled")
+	errSessionRequeued  = errors.New("judge session requeued")
+	errSessionHandedOff = errors.New("judge session handed off")
+	errSessionLocked    = errors.New("judge session is locked by another manager")
+)
+
+func lockKeyOf(id string) string {
+	return fmt.Sprintf("%s:%s", judgeSessionLockKeyPrefix, id)
+}
+
 type JudgeSession struct {
 	id string
 	m  *Manager
@@ -22,12 +36,39 @@ type JudgeSession struct {
 
 	closeChan chan struct{}
 
+	// ctx is cancelled with one of the errSession* causes to stop the session
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
 	soln *aoiclient.SolutionPoll
 	aoi  *aoiclient.SolutionClient
 
 	stopped *atomic.Int32
 
 	rc *RunningConfig
+	// Set if the judge config is invalid, the session fails right away
+	configErr error
+	// Namespace templates at the start of the session
+	tmpls *TemplateSet
+
+	startedAt time.Time
+	// Name of the running stage
+	stage string
+	// Set once the judge quits, the remaining stages are skipped
+	quit bool
+	// Set once the judge completes the solution by itself
+	completed bool
+	// Cached problem data directory, empty if not cached
+	problemData string
+
+	// Timers paused while the session is queued
+	timers     map[*pausableTimer]bool
+	timersLock *sync.Mutex
+	queued     bool
+	// Runs only while the session is queued, nil if unbounded
+	queueTimer *pausableTimer
+	// Reported once, a judge may be queued again if it's preempted
+	reportedQueued bool
 }
 
 func NewJudgeSession(id string, m *Manager) (*JudgeSession, error) {
@@ -35,6 +76,9 @@ func NewJudgeSession(id string, m *Manager) (*JudgeSession, error) {
 		id:      id,
 		m:       m,
 		stopped: new(atomic.Int32),
+
+		timers:     make(map[*pausableTimer]bool),
+		timersLock: &sync.Mutex{},
 	}
 
 	err := s.init()
@@ -46,8 +90,9 @@ func NewJudgeSession(id string, m *Manager) (*JudgeSession, error) {
 }
 
 func (s *JudgeSession) init() error {
-	s.lockKey = fmt.Sprintf("%s:%s", judgeSessionLockKeyPrefix, s.id)
+	s.lockKey = lockKeyOf(s.id)
 	s.closeChan = make(chan struct{})
+	s.ctx, s.cancel = context.WithCancelCause(context.Background())
 
 	var err error
 	s.soln, err = s.m.r.GetSolutionPoll(s.id)
@@ -55,12 +100,17 @@ func (s *JudgeSession) init() error {
 		return err
 	}
 
+	// Running it again won't help, it's failed once locked
 	s.rc = new(RunningConfig)
 	err = json.Unmarshal(s.soln.ProblemConfig.Judge.Config, s.rc)
+	if err != nil {
+		s.configErr = newStatusError(aoiclient.StatusError, "Invalid judge config: %v", err)
+	}
 
 	s.aoi = s.m.aoi.Solution(s.soln.SolutionId, s.soln.TaskId)
+	s.tmpls = s.m.tmpls.Load()
 
-	return err
+	return nil
 }
 
 func (s *JudgeSession) tryLock() (bool, error) {
@@ -93,14 +143,28 @@ func (s *JudgeSession) cleanup() error {
 		return nil
 	}
 
-	s.closeChan <- struct{}{}
+	close(s.closeChan)
+	s.m.unregisterSession(s)
 
-	err := s.m.r.DeleteSolutionPoll(s.id)
-	if err != nil {
-		return err
+	// A requeued, handed off or retried session is kept for the next run
+	if !s.isKept() {
+		err := s.archiveLogs()
+		if err != nil {
+			log.Println("Failed to archive logs:", err)
+		}
+
+		err = s.m.r.DeleteSolutionPoll(s.id)
+		if err != nil {
+			return err
+		}
+
+		err = s.m.r.DeleteAttempts(s.id)
+		if err != nil {
+			return err
+		}
 	}
 
-	err = s.unlock()
+	err := s.unlock()
 	if err != nil {
 		return err
 	}
@@ -116,13 +180,62 @@ func (s *JudgeSession) Close() {
 }
 
 func (s *JudgeSession) Run() error {
-	if ok, err := s.tryLock(); !ok || err != nil {
+	ok, err := s.tryLock()
+	if err != nil {
 		return wrapError("tryLock", err)
 	}
+	if !ok {
+		return errSessionLocked
+	}
+
+	s.startedAt = time.Now()
+	defer observeSince(metricSessionDuration, s.startedAt)
 
+	s.m.registerSession(s)
 	go s.lockLoop()
 	defer s.cleanup()
 
 	// Do the real judge code here
-	return s.run()
+	err = s.configErr
+	if err == nil {
+		err = s.run()
+	}
+
+	// Report why the session is stopped rather than the resulting error
+	if cause := context.Cause(s.ctx); cause != nil {
+		return cause
+	}
+
+	// Running the judge again would judge the solution twice
+	if err != nil && s.completed {
+		log.Println("Ignoring error after completing solution", s.id, ":", err)
+		err = nil
+	}
+
+	if isTransient(err) {
+		attempt, rErr := s.m.shouldRetry(s.id)
+		if rErr != nil {
+			log.Println("Failed to count attempts:", rErr)
+		}
+		if attempt > 0 {
+			s.cancel(&retryError{err: err, attempt: attempt})
+			return context.Cause(s.ctx)
+		}
+	}
+	s.cancel(nil)
+
+	return err
+}
+
+// isKept reports whether the session is stopped to be run again later
+func (s *JudgeSession) isKept() bool {
+	cause := context.Cause(s.ctx)
+	var retry *retryError
+	return errors.Is(cause, errSessionRequeued) || errors.Is(cause, errSessionHandedOff) ||
+		errors.As(cause, &retry)
+}
+
+// Stop interrupts a running session, cause is returned by Run
+func (s *JudgeSession) Stop(cause error) {
+	s.cancel(cause)
 }
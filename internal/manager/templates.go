@@ -1,50 +1,254 @@
 package manager
 
 import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"text/template"
+
+	"sigs.k8s.io/yaml"
 )
 
-func (m *Manager) loadTemplates() error {
-	tplPath := *m.conf.TemplatePath
-	entries, err := os.ReadDir(tplPath)
+// TemplateSet holds the namespace templates under TemplatePath. Top level
+// files are rendered for every session, files in a subdirectory form a
+// named set, rendered after them for the problems selecting it with
+// RunningConfig.TemplateSet.
+type TemplateSet struct {
+	Default []*template.Template
+	Named   map[string][]*template.Template
+}
+
+// TemplateValues is what the namespace templates are executed with
+type TemplateValues struct {
+	Namespace string
+	Variables map[string]interface{}
+	Context   *JudgeContext
+}
+
+var templateFuncs = template.FuncMap{
+	"default":  defaultValue,
+	"required": requiredValue,
+	"toYaml":   toYaml,
+	"quote":    quote,
+	"b64enc":   b64enc,
+	"indent":   indent,
+}
+
+func isEmptyValue(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return rv.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return rv.IsNil()
+	}
+	return rv.IsZero()
+}
+
+// defaultValue returns v, or def if v is empty: {{ default "1Gi" .Variables.memory }}
+func defaultValue(def interface{}, v interface{}) interface{} {
+	if isEmptyValue(v) {
+		return def
+	}
+	return v
+}
+
+// requiredValue fails the rendering with msg if v is empty
+func requiredValue(msg string, v interface{}) (interface{}, error) {
+	if isEmptyValue(v) {
+		return nil, errors.New(msg)
+	}
+	return v, nil
+}
+
+func toYaml(v interface{}) (string, error) {
+	b, err := yaml.Marshal(v)
 	if err != nil {
-		return err
+		return "", err
 	}
+	return strings.TrimSuffix(string(b), "\n"), nil
+}
 
-	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].Name() < entries[j].Name()
-	})
+func quote(v interface{}) string {
+	if v == nil {
+		return `""`
+	}
+	return strconv.Quote(fmt.Sprint(v))
+}
+
+func b64enc(v interface{}) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprint(v)))
+}
+
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+// LoadTemplateSet parses the templates under dir
+func LoadTemplateSet(dir string) (*TemplateSet, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := &TemplateSet{
+		Named: make(map[string][]*template.Template),
+	}
+
+	ts.Default, err = parseTemplates(dir, "", false)
+	if err != nil {
+		return nil, err
+	}
 
-	var files []string
 	for _, entry := range entries {
-		if entry.IsDir() {
-			// TODO: Support sub directories
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+		isDir, err := isTemplateDir(path)
+		if err != nil {
+			return nil, err
+		}
+		if !isDir {
 			continue
 		}
+
+		ts.Named[name], err = parseTemplates(path, name, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ts, nil
+}
+
+// isTemplateDir reports whether path is a directory of templates. Hidden
+// ones are skipped, e.g. ..data of a mounted ConfigMap, and symlinks are
+// followed, since a mounted ConfigMap is made of them.
+func isTemplateDir(path string) (bool, error) {
+	if strings.HasPrefix(filepath.Base(path), ".") {
+		return false, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return info.IsDir(), nil
+}
+
+// templateFiles lists the YAML files in dir, in subdirectories as well if
+// recursive
+func templateFiles(dir string, recursive bool) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
 		name := entry.Name()
-		if !strings.HasSuffix(name, ".yaml") && !strings.HasSuffix(name, ".yml") {
+		path := filepath.Join(dir, name)
+
+		isDir, err := isTemplateDir(path)
+		if err != nil {
+			return nil, err
+		}
+		if isDir {
+			if !recursive {
+				continue
+			}
+			sub, err := templateFiles(path, true)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, sub...)
 			continue
 		}
 
-		fullPath := filepath.Join(tplPath, name)
-		content, err := os.ReadFile(fullPath)
-		if err != nil {
-			return err
+		if strings.HasPrefix(name, ".") {
+			continue
 		}
-		files = append(files, string(content))
+		if !strings.HasSuffix(name, ".yaml") && !strings.HasSuffix(name, ".yml") {
+			continue
+		}
+		files = append(files, path)
 	}
 
+	return files, nil
+}
+
+// parseTemplates parses the templates in dir in order of their paths, which
+// are used as the template names under prefix
+func parseTemplates(dir string, prefix string, recursive bool) ([]*template.Template, error) {
+	files, err := templateFiles(dir, recursive)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var tmpls []*template.Template
 	for _, file := range files {
-		t, err := template.New("judge-tmpl").Parse(file)
+		content, err := os.ReadFile(file)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		m.tmpls = append(m.tmpls, t)
+
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return nil, err
+		}
+
+		t, err := template.New(filepath.Join(prefix, rel)).
+			Funcs(templateFuncs).
+			Parse(string(content))
+		if err != nil {
+			return nil, err
+		}
+		tmpls = append(tmpls, t)
 	}
 
-	return nil
+	return tmpls, nil
+}
+
+// Select returns the templates to render for the named set, which is empty
+// for the default templates only
+func (ts *TemplateSet) Select(name string) ([]*template.Template, error) {
+	if name == "" {
+		return ts.Default, nil
+	}
+
+	named, ok := ts.Named[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown template set: %s", name)
+	}
+
+	tmpls := make([]*template.Template, 0, len(ts.Default)+len(named))
+	tmpls = append(tmpls, ts.Default...)
+	return append(tmpls, named...), nil
+}
+
+// Render executes the templates, each of which results in a YAML document
+// of one or more objects
+func Render(tmpls []*template.Template, values *TemplateValues) ([]string, error) {
+	var docs []string
+	for _, tmpl := range tmpls {
+		buf := bytes.NewBuffer(nil)
+		err := tmpl.Execute(buf, values)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, buf.String())
+	}
+	return docs, nil
 }
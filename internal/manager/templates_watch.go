@@ -0,0 +1,82 @@
+package manager
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Changes come in bursts, e.g. a ConfigMap update swaps ..data and removes
+// the old version, so reload once they settle
+const templateReloadDelay = time.Second
+
+// reloadTemplates parses the templates again, the current set is kept if
+// any of them doesn't parse
+func (m *Manager) reloadTemplates() {
+	tmpls, err := LoadTemplateSet(*m.conf.TemplatePath)
+	if err != nil {
+		log.Println("Failed to reload templates, keeping the current ones:", err)
+		metricTemplateReloads.WithLabelValues("failure").Inc()
+		return
+	}
+
+	m.tmpls.Store(tmpls)
+	metricTemplateReloads.WithLabelValues("success").Inc()
+	log.Println("Reloaded", len(tmpls.Default), "namespace templates and", len(tmpls.Named), "template sets")
+}
+
+// watchTemplates reloads the templates on changes under TemplatePath
+func (m *Manager) watchTemplates(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Println("Failed to watch templates:", err)
+		return
+	}
+	defer watcher.Close()
+
+	watchDirs := func() {
+		root := *m.conf.TemplatePath
+		err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return watcher.Add(path)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Println("Failed to watch templates:", err)
+		}
+	}
+	watchDirs()
+
+	var reload <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			// Directories may be created, watch them as well
+			if event.Has(fsnotify.Create) {
+				watchDirs()
+			}
+			reload = time.After(templateReloadDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("Template watcher error:", err)
+		case <-reload:
+			reload = nil
+			m.reloadTemplates()
+		}
+	}
+}
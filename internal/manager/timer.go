@@ -0,0 +1,151 @@
+package manager
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lcpu-club/hpcgame-judger/pkg/aoiclient"
+)
+
+// pausableTimer calls f once it has been running for d, not counting the
+// time it's paused
+type pausableTimer struct {
+	lock *sync.Mutex
+
+	f         func()
+	remaining time.Duration
+	// Nil while paused or stopped
+	timer   *time.Timer
+	started time.Time
+	stopped bool
+}
+
+func newPausableTimer(d time.Duration, f func(), paused bool) *pausableTimer {
+	t := &pausableTimer{
+		lock:      &sync.Mutex{},
+		f:         f,
+		remaining: d,
+	}
+	if !paused {
+		t.Resume()
+	}
+	return t
+}
+
+func (t *pausableTimer) Pause() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.timer == nil {
+		return
+	}
+	if t.timer.Stop() {
+		t.remaining -= time.Since(t.started)
+	} else {
+		// Fired already
+		t.stopped = true
+	}
+	t.timer = nil
+}
+
+func (t *pausableTimer) Resume() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.timer != nil || t.stopped {
+		return
+	}
+	t.started = time.Now()
+	t.timer = time.AfterFunc(max(t.remaining, 0), t.f)
+}
+
+func (t *pausableTimer) Stop() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.stopped = true
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
+
+// startTimer calls f after d, the time the session is queued for resources
+// doesn't count
+func (s *JudgeSession) startTimer(d time.Duration, f func()) *pausableTimer {
+	s.timersLock.Lock()
+	defer s.timersLock.Unlock()
+
+	t := newPausableTimer(d, f, s.queued)
+	s.timers[t] = true
+	return t
+}
+
+func (s *JudgeSession) stopTimer(t *pausableTimer) {
+	s.timersLock.Lock()
+	defer s.timersLock.Unlock()
+
+	t.Stop()
+	delete(s.timers, t)
+}
+
+// startQueueTimer calls f once the session has been queued for d in total
+func (s *JudgeSession) startQueueTimer(d time.Duration, f func()) *pausableTimer {
+	s.timersLock.Lock()
+	defer s.timersLock.Unlock()
+
+	s.queueTimer = newPausableTimer(d, f, !s.queued)
+	return s.queueTimer
+}
+
+// setQueued pauses the timers of the session while the workload waits for
+// resources, e.g. for quota in a Kueue queue. The solution is reported as
+// queued the first time.
+func (s *JudgeSession) setQueued(queued bool, reason string) {
+	s.timersLock.Lock()
+	if s.queued == queued {
+		s.timersLock.Unlock()
+		return
+	}
+	s.queued = queued
+
+	for t := range s.timers {
+		if queued {
+			t.Pause()
+		} else {
+			t.Resume()
+		}
+	}
+	if s.queueTimer != nil {
+		if queued {
+			s.queueTimer.Resume()
+		} else {
+			s.queueTimer.Pause()
+		}
+	}
+
+	report := queued && !s.reportedQueued
+	if report {
+		s.reportedQueued = true
+	}
+	s.timersLock.Unlock()
+
+	if !queued {
+		log.Println("Session", s.id, "is admitted")
+		return
+	}
+	log.Println("Session", s.id, "is queued:", reason)
+
+	if !report {
+		return
+	}
+	err := observeAOIError(s.aoi.Patch(context.TODO(), &aoiclient.SolutionInfo{
+		Status:  aoiclient.StatusQueued,
+		Message: reason,
+	}))
+	if err != nil {
+		log.Println("Failed to report queued solution:", err)
+	}
+}
@@ -1,18 +1,19 @@
 package manager
 
 import (
-	"fmt"
+	"context"
 	"log"
 	"time"
+
+	"github.com/redis/go-redis/v9"
 )
 
 func (m *Manager) isLocked(id string) (bool, error) {
-	lockKey := fmt.Sprintf("%s:%s", judgeSessionLockKeyPrefix, id)
-	return m.r.IsLocked(lockKey)
+	return m.r.IsLocked(lockKeyOf(id))
 }
 
-// Find admitted but not running jobs (no lock)
-// and run them
+// Find admitted sessions owned by no one, i.e. neither running, queued
+// nor claimed, and queue them again
 func (m *Manager) findNotRunning() error {
 	s, err := m.r.ListSolutionPoll()
 	if err != nil {
@@ -20,29 +21,60 @@ func (m *Manager) findNotRunning() error {
 	}
 
 	for _, item := range s {
-		locked, err := m.isLocked(item)
+		// Owned from now on, nobody else can pick it up in the meantime
+		ok, err := m.claimSession(item)
 		if err != nil {
-			log.Println("Failed to check lock:", err)
+			log.Println("Failed to claim session:", err)
 			continue
 		}
-
-		if locked {
+		if !ok {
 			continue
 		}
 
-		go m.run(item)
+		err = m.requeueClaimed(item)
+		if err != nil {
+			log.Println("Failed to queue solution:", err)
+		}
+		m.releaseClaim(item)
 	}
 	return nil
 }
 
-const findNotRunningInterval = 8 * time.Minute
+// requeueClaimed queues a session claimed by this manager
+func (m *Manager) requeueClaimed(id string) error {
+	// Run once a rate limit token is available
+	soln, err := m.r.GetSolutionPoll(id)
+	if err == redis.Nil {
+		// Finished in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Println("Recovering solution", id)
+	return m.q.Push(id, soln)
+}
 
-func (m *Manager) findNotRunningLoop() {
+// findNotRunningLoop runs the recovery on the leader, right away once
+// elected, then every RecoveryInterval
+func (m *Manager) findNotRunningLoop(ctx context.Context) {
+	var last time.Time
 	for {
-		err := m.findNotRunning()
-		if err != nil {
-			log.Println("Failed to find not running:", err)
+		if !m.isLeader() {
+			last = time.Time{}
+		} else if time.Since(last) >= *m.conf.RecoveryInterval {
+			last = time.Now()
+			err := m.findNotRunning()
+			if err != nil {
+				log.Println("Failed to find not running:", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(leaderRenewInterval):
 		}
-		time.Sleep(findNotRunningInterval)
 	}
 }
@@ -0,0 +1,473 @@
+// Package policy checks what a problem config asks Kubernetes to run
+// against the limits set by the operators, before anything is submitted
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/lcpu-club/hpcgame-judger/internal/kube"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+// Policy limits the pods of the judge jobs and namespace objects
+type Policy struct {
+	// AllowedRegistries are the registries, or repository prefixes, images
+	// may come from, e.g. "docker.io/library". Any image if empty.
+	AllowedRegistries []string `json:"allowedRegistries,omitempty"`
+
+	// MaxRequests and MaxLimits bound the resources of every container,
+	// which must set the bounded ones
+	MaxRequests corev1.ResourceList `json:"maxRequests,omitempty"`
+	MaxLimits   corev1.ResourceList `json:"maxLimits,omitempty"`
+
+	// MaxParallelism bounds the parallelism of jobs and the replicas of
+	// other workloads, MaxCompletions the completions of jobs. Unbounded if
+	// 0.
+	MaxParallelism int32 `json:"maxParallelism,omitempty"`
+	MaxCompletions int32 `json:"maxCompletions,omitempty"`
+
+	// ForbiddenVolumes are volume types, named as in the pod spec, e.g.
+	// "hostPath"
+	ForbiddenVolumes []string `json:"forbiddenVolumes,omitempty"`
+
+	// AllowHostNamespaces allows hostNetwork, hostPID, hostIPC and host
+	// ports
+	AllowHostNamespaces bool `json:"allowHostNamespaces,omitempty"`
+	// AllowPrivileged allows privileged containers, and lifting the
+	// confinement of containers, e.g. an unconfined seccomp profile
+	AllowPrivileged bool `json:"allowPrivileged,omitempty"`
+	// AllowPrivilegeEscalation allows allowPrivilegeEscalation: true
+	AllowPrivilegeEscalation bool `json:"allowPrivilegeEscalation,omitempty"`
+	// AllowedCapabilities are the capabilities containers may add
+	AllowedCapabilities []string `json:"allowedCapabilities,omitempty"`
+	// AllowedSysctls are the sysctls pods may set
+	AllowedSysctls []string `json:"allowedSysctls,omitempty"`
+	// RequireNonRoot requires containers to run as a non-root user
+	RequireNonRoot bool `json:"requireNonRoot,omitempty"`
+}
+
+// Default is used without a policy file, it only forbids escaping to the
+// node. The capabilities and sysctls are those of the baseline Pod Security
+// Standard.
+func Default() *Policy {
+	return &Policy{
+		ForbiddenVolumes: []string{"hostPath"},
+		AllowedCapabilities: []string{
+			"AUDIT_WRITE", "CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "KILL", "MKNOD",
+			"NET_BIND_SERVICE", "SETFCAP", "SETGID", "SETPCAP", "SETUID", "SYS_CHROOT",
+		},
+		AllowedSysctls: []string{
+			"kernel.shm_rmid_forced",
+			"net.ipv4.ip_local_port_range",
+			"net.ipv4.ip_local_reserved_ports",
+			"net.ipv4.ip_unprivileged_port_start",
+			"net.ipv4.ping_group_range",
+			"net.ipv4.tcp_syncookies",
+			"net.ipv4.tcp_keepalive_time",
+			"net.ipv4.tcp_fin_timeout",
+			"net.ipv4.tcp_keepalive_intvl",
+			"net.ipv4.tcp_keepalive_probes",
+		},
+	}
+}
+
+// Load reads a policy from a YAML or JSON file, unset fields keep the
+// defaults
+func Load(file string) (*Policy, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	p := Default()
+	err = yaml.UnmarshalStrict(content, p)
+	if err != nil {
+		return nil, fmt.Errorf("policy %s: %w", file, err)
+	}
+	return p, nil
+}
+
+// Violation is a field breaking the policy
+type Violation struct {
+	Object string
+	Field  string
+	Reason string
+}
+
+func (v *Violation) String() string {
+	return fmt.Sprintf("%s: %s: %s", v.Object, v.Field, v.Reason)
+}
+
+// Error lists every violation of an object set
+type Error struct {
+	Violations []*Violation
+}
+
+func (e *Error) Error() string {
+	lines := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		lines = append(lines, v.String())
+	}
+	return "policy violation: " + strings.Join(lines, "; ")
+}
+
+type checker struct {
+	p      *Policy
+	object string
+
+	violations []*Violation
+}
+
+func (c *checker) fail(field string, format string, a ...interface{}) {
+	c.violations = append(c.violations, &Violation{
+		Object: c.object,
+		Field:  field,
+		Reason: fmt.Sprintf(format, a...),
+	})
+}
+
+func (c *checker) err() error {
+	if len(c.violations) == 0 {
+		return nil
+	}
+	return &Error{Violations: c.violations}
+}
+
+// CheckJob checks a job and its pod template
+func (p *Policy) CheckJob(job *batchv1.Job) error {
+	c := &checker{p: p, object: "Job " + job.Name}
+	c.checkJobSpec("spec", job.Spec.Parallelism, job.Spec.Completions)
+	c.checkPodSpec("spec.template.spec", &job.Spec.Template.Spec)
+	return c.err()
+}
+
+// workload is where a kind running pods holds its pod spec, and the job spec
+// or the replicas if it has them
+type workload struct {
+	podSpec  []string
+	jobSpec  []string
+	replicas []string
+}
+
+var workloads = map[string]*workload{
+	"Pod": {podSpec: []string{"spec"}},
+	"Job": {
+		podSpec: []string{"spec", "template", "spec"},
+		jobSpec: []string{"spec"},
+	},
+	"CronJob": {
+		podSpec: []string{"spec", "jobTemplate", "spec", "template", "spec"},
+		jobSpec: []string{"spec", "jobTemplate", "spec"},
+	},
+	"Deployment": {
+		podSpec:  []string{"spec", "template", "spec"},
+		replicas: []string{"spec", "replicas"},
+	},
+	"StatefulSet": {
+		podSpec:  []string{"spec", "template", "spec"},
+		replicas: []string{"spec", "replicas"},
+	},
+	"ReplicaSet": {
+		podSpec:  []string{"spec", "template", "spec"},
+		replicas: []string{"spec", "replicas"},
+	},
+	"DaemonSet": {podSpec: []string{"spec", "template", "spec"}},
+}
+
+// nestedInt32 returns the integer at path, nil if it's not set
+func nestedInt32(obj map[string]interface{}, path ...string) *int32 {
+	v, found, err := unstructured.NestedFieldNoCopy(obj, path...)
+	if err != nil || !found {
+		return nil
+	}
+
+	var n int64
+	switch v := v.(type) {
+	case int64:
+		n = v
+	case float64:
+		n = int64(v)
+	default:
+		return nil
+	}
+	i := int32(n)
+	return &i
+}
+
+// CheckObjects checks the workloads of the objects in a YAML string, e.g.
+// the rendered namespace templates. Objects not running pods are skipped.
+func (p *Policy) CheckObjects(str string) error {
+	var violations []*Violation
+
+	for _, doc := range kube.SplitDocuments(str) {
+		obj := &unstructured.Unstructured{}
+		err := yaml.Unmarshal([]byte(doc), &obj.Object)
+		if err != nil {
+			return err
+		}
+		if obj.Object == nil {
+			continue
+		}
+
+		w, ok := workloads[obj.GetKind()]
+		if !ok {
+			continue
+		}
+		c := &checker{p: p, object: obj.GetKind() + " " + obj.GetName()}
+
+		if w.jobSpec != nil {
+			c.checkJobSpec(strings.Join(w.jobSpec, "."),
+				nestedInt32(obj.Object, append(slices.Clone(w.jobSpec), "parallelism")...),
+				nestedInt32(obj.Object, append(slices.Clone(w.jobSpec), "completions")...))
+		}
+		if w.replicas != nil {
+			c.checkReplicas(strings.Join(w.replicas, "."), nestedInt32(obj.Object, w.replicas...))
+		}
+
+		raw, found, err := unstructured.NestedMap(obj.Object, w.podSpec...)
+		if err != nil || !found {
+			violations = append(violations, c.violations...)
+			continue
+		}
+		spec := &corev1.PodSpec{}
+		err = runtime.DefaultUnstructuredConverter.FromUnstructured(raw, spec)
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", obj.GetKind(), obj.GetName(), err)
+		}
+
+		c.checkPodSpec(strings.Join(w.podSpec, "."), spec)
+		violations = append(violations, c.violations...)
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+	return &Error{Violations: violations}
+}
+
+func (c *checker) checkJobSpec(path string, parallelism *int32, completions *int32) {
+	if c.p.MaxParallelism > 0 && parallelism != nil && *parallelism > c.p.MaxParallelism {
+		c.fail(path+".parallelism", "%d exceeds the maximum of %d", *parallelism, c.p.MaxParallelism)
+	}
+	if c.p.MaxCompletions > 0 && completions != nil && *completions > c.p.MaxCompletions {
+		c.fail(path+".completions", "%d exceeds the maximum of %d", *completions, c.p.MaxCompletions)
+	}
+}
+
+func (c *checker) checkReplicas(path string, replicas *int32) {
+	if c.p.MaxParallelism > 0 && replicas != nil && *replicas > c.p.MaxParallelism {
+		c.fail(path, "%d exceeds the maximum of %d", *replicas, c.p.MaxParallelism)
+	}
+}
+
+func (c *checker) checkPodSpec(path string, spec *corev1.PodSpec) {
+	if !c.p.AllowHostNamespaces {
+		if spec.HostNetwork {
+			c.fail(path+".hostNetwork", "host networking is forbidden")
+		}
+		if spec.HostPID {
+			c.fail(path+".hostPID", "host PID namespace is forbidden")
+		}
+		if spec.HostIPC {
+			c.fail(path+".hostIPC", "host IPC namespace is forbidden")
+		}
+	}
+
+	if spec.SecurityContext != nil {
+		c.checkPodSecurityContext(path+".securityContext", spec.SecurityContext)
+	}
+
+	for i := range spec.Volumes {
+		c.checkVolume(fmt.Sprintf("%s.volumes[%d]", path, i), &spec.Volumes[i])
+	}
+	for i := range spec.InitContainers {
+		c.checkContainer(fmt.Sprintf("%s.initContainers[%d]", path, i), &spec.InitContainers[i], spec.SecurityContext)
+	}
+	for i := range spec.Containers {
+		c.checkContainer(fmt.Sprintf("%s.containers[%d]", path, i), &spec.Containers[i], spec.SecurityContext)
+	}
+	for i := range spec.EphemeralContainers {
+		ctr := corev1.Container(spec.EphemeralContainers[i].EphemeralContainerCommon)
+		c.checkContainer(fmt.Sprintf("%s.ephemeralContainers[%d]", path, i), &ctr, spec.SecurityContext)
+	}
+}
+
+func (c *checker) checkPodSecurityContext(path string, sc *corev1.PodSecurityContext) {
+	for i, s := range sc.Sysctls {
+		if !slices.Contains(c.p.AllowedSysctls, s.Name) {
+			c.fail(fmt.Sprintf("%s.sysctls[%d]", path, i), "sysctl %s is forbidden", s.Name)
+		}
+	}
+
+	if c.p.AllowPrivileged {
+		return
+	}
+	c.checkConfinement(path, sc.SeccompProfile, sc.AppArmorProfile, sc.SELinuxOptions, sc.WindowsOptions)
+}
+
+// checkConfinement checks the fields lifting the confinement of containers,
+// which are the same at the pod and the container level
+func (c *checker) checkConfinement(path string, seccomp *corev1.SeccompProfile, apparmor *corev1.AppArmorProfile,
+	selinux *corev1.SELinuxOptions, windows *corev1.WindowsSecurityContextOptions) {
+	if seccomp != nil && seccomp.Type == corev1.SeccompProfileTypeUnconfined {
+		c.fail(path+".seccompProfile", "unconfined seccomp profile is forbidden")
+	}
+	if apparmor != nil && apparmor.Type == corev1.AppArmorProfileTypeUnconfined {
+		c.fail(path+".appArmorProfile", "unconfined AppArmor profile is forbidden")
+	}
+	if selinux != nil && (selinux.User != "" || selinux.Role != "") {
+		c.fail(path+".seLinuxOptions", "custom SELinux user and role are forbidden")
+	}
+	if windows != nil && windows.HostProcess != nil && *windows.HostProcess {
+		c.fail(path+".windowsOptions.hostProcess", "host processes are forbidden")
+	}
+}
+
+// volumeType returns the name of the source of the volume, e.g. hostPath
+func volumeType(v *corev1.Volume) string {
+	b, err := json.Marshal(v.VolumeSource)
+	if err != nil {
+		return ""
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(b, &fields) != nil {
+		return ""
+	}
+	for name := range fields {
+		return name
+	}
+	return ""
+}
+
+func (c *checker) checkVolume(path string, v *corev1.Volume) {
+	if t := volumeType(v); slices.Contains(c.p.ForbiddenVolumes, t) {
+		c.fail(path, "volume %s: type %s is forbidden", v.Name, t)
+	}
+}
+
+// normalizeCapability returns the capability as named in the pod spec, e.g.
+// SYS_ADMIN for cap_sys_admin
+func normalizeCapability(capability corev1.Capability) string {
+	return strings.TrimPrefix(strings.ToUpper(string(capability)), "CAP_")
+}
+
+func (c *checker) checkContainer(path string, ctr *corev1.Container, pod *corev1.PodSecurityContext) {
+	if len(c.p.AllowedRegistries) > 0 && !imageAllowed(ctr.Image, c.p.AllowedRegistries) {
+		c.fail(path+".image", "image %q is not from an allowed registry", ctr.Image)
+	}
+
+	if !c.p.AllowHostNamespaces {
+		for i, port := range ctr.Ports {
+			if port.HostPort != 0 {
+				c.fail(fmt.Sprintf("%s.ports[%d].hostPort", path, i), "host ports are forbidden")
+			}
+		}
+	}
+
+	c.checkSecurityContext(path+".securityContext", ctr.SecurityContext, pod)
+
+	checkResources(c, path+".resources.requests", ctr.Resources.Requests, c.p.MaxRequests)
+	checkResources(c, path+".resources.limits", ctr.Resources.Limits, c.p.MaxLimits)
+}
+
+func (c *checker) checkSecurityContext(path string, sc *corev1.SecurityContext, pod *corev1.PodSecurityContext) {
+	if c.p.RequireNonRoot && !runsAsNonRoot(sc, pod) {
+		c.fail(path+".runAsNonRoot", "containers must run as a non-root user")
+	}
+
+	if sc == nil {
+		return
+	}
+
+	if !c.p.AllowPrivileged {
+		if sc.Privileged != nil && *sc.Privileged {
+			c.fail(path+".privileged", "privileged containers are forbidden")
+		}
+		if sc.ProcMount != nil && *sc.ProcMount == corev1.UnmaskedProcMount {
+			c.fail(path+".procMount", "unmasked /proc is forbidden")
+		}
+		c.checkConfinement(path, sc.SeccompProfile, sc.AppArmorProfile, sc.SELinuxOptions, sc.WindowsOptions)
+	}
+
+	if !c.p.AllowPrivilegeEscalation && sc.AllowPrivilegeEscalation != nil && *sc.AllowPrivilegeEscalation {
+		c.fail(path+".allowPrivilegeEscalation", "privilege escalation is forbidden")
+	}
+
+	if sc.Capabilities != nil {
+		for i, capability := range sc.Capabilities.Add {
+			if !slices.Contains(c.p.AllowedCapabilities, normalizeCapability(capability)) {
+				c.fail(fmt.Sprintf("%s.capabilities.add[%d]", path, i), "capability %s is forbidden", capability)
+			}
+		}
+	}
+}
+
+// runsAsNonRoot reports whether the container is sure to run as a non-root
+// user, the container security context overrides the pod one
+func runsAsNonRoot(sc *corev1.SecurityContext, pod *corev1.PodSecurityContext) bool {
+	var nonRoot *bool
+	var user *int64
+	if pod != nil {
+		nonRoot, user = pod.RunAsNonRoot, pod.RunAsUser
+	}
+	if sc != nil {
+		if sc.RunAsNonRoot != nil {
+			nonRoot = sc.RunAsNonRoot
+		}
+		if sc.RunAsUser != nil {
+			user = sc.RunAsUser
+		}
+	}
+
+	if user != nil {
+		return *user != 0
+	}
+	return nonRoot != nil && *nonRoot
+}
+
+func checkResources(c *checker, path string, got corev1.ResourceList, max corev1.ResourceList) {
+	for _, name := range slices.Sorted(maps.Keys(max)) {
+		limit := max[name]
+		q, ok := got[name]
+		if !ok {
+			c.fail(path+"."+string(name), "must be set, at most %s", limit.String())
+			continue
+		}
+		if q.Cmp(limit) > 0 {
+			c.fail(path+"."+string(name), "%s exceeds the maximum of %s", q.String(), limit.String())
+		}
+	}
+}
+
+// normalizeImage returns the image with its registry, as docker pull does,
+// e.g. busybox is docker.io/library/busybox
+func normalizeImage(image string) string {
+	first, rest, found := strings.Cut(image, "/")
+	if !found {
+		return "docker.io/library/" + image
+	}
+	if strings.ContainsAny(first, ".:") || first == "localhost" {
+		return image
+	}
+	return "docker.io/" + first + "/" + rest
+}
+
+func imageAllowed(image string, allowed []string) bool {
+	image = normalizeImage(image)
+	for _, prefix := range allowed {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if strings.HasPrefix(image, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
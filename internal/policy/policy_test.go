@@ -0,0 +1,460 @@
+package policy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/utils/ptr"
+)
+
+// violatedFields returns the fields of the violations in err
+func violatedFields(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+
+	var pe *Error
+	if !errors.As(err, &pe) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var fields []string
+	for _, v := range pe.Violations {
+		fields = append(fields, v.Object+": "+v.Field)
+	}
+	return fields
+}
+
+func newJob() *batchv1.Job {
+	job := &batchv1.Job{}
+	job.Name = "judge"
+	job.Spec.Template.Spec.Containers = []corev1.Container{{
+		Name:  "judge",
+		Image: "busybox",
+	}}
+	return job
+}
+
+func TestCheckJob(t *testing.T) {
+	limited := func(p *Policy) {
+		p.MaxLimits = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("4")}
+	}
+
+	tests := []struct {
+		name   string
+		policy func(p *Policy)
+		job    func(job *batchv1.Job)
+		want   []string
+	}{
+		{
+			name: "allowed",
+			job: func(job *batchv1.Job) {
+				job.Spec.Template.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{
+					Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"NET_BIND_SERVICE"}},
+				}
+			},
+		},
+		{
+			name: "host network",
+			job: func(job *batchv1.Job) {
+				job.Spec.Template.Spec.HostNetwork = true
+			},
+			want: []string{"Job judge: spec.template.spec.hostNetwork"},
+		},
+		{
+			name:   "host network allowed",
+			policy: func(p *Policy) { p.AllowHostNamespaces = true },
+			job: func(job *batchv1.Job) {
+				job.Spec.Template.Spec.HostNetwork = true
+			},
+		},
+		{
+			name: "host PID and IPC",
+			job: func(job *batchv1.Job) {
+				job.Spec.Template.Spec.HostPID = true
+				job.Spec.Template.Spec.HostIPC = true
+			},
+			want: []string{
+				"Job judge: spec.template.spec.hostPID",
+				"Job judge: spec.template.spec.hostIPC",
+			},
+		},
+		{
+			name: "host port",
+			job: func(job *batchv1.Job) {
+				job.Spec.Template.Spec.Containers[0].Ports = []corev1.ContainerPort{{ContainerPort: 80, HostPort: 80}}
+			},
+			want: []string{"Job judge: spec.template.spec.containers[0].ports[0].hostPort"},
+		},
+		{
+			name: "hostPath volume",
+			job: func(job *batchv1.Job) {
+				job.Spec.Template.Spec.Volumes = []corev1.Volume{
+					{Name: "data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+					{Name: "root", VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/"}}},
+				}
+			},
+			want: []string{"Job judge: spec.template.spec.volumes[1]"},
+		},
+		{
+			name: "privileged",
+			job: func(job *batchv1.Job) {
+				job.Spec.Template.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{Privileged: ptr.To(true)}
+			},
+			want: []string{"Job judge: spec.template.spec.containers[0].securityContext.privileged"},
+		},
+		{
+			name: "privileged init container",
+			job: func(job *batchv1.Job) {
+				job.Spec.Template.Spec.InitContainers = []corev1.Container{{
+					Name:            "init",
+					Image:           "busybox",
+					SecurityContext: &corev1.SecurityContext{Privileged: ptr.To(true)},
+				}}
+			},
+			want: []string{"Job judge: spec.template.spec.initContainers[0].securityContext.privileged"},
+		},
+		{
+			name: "privileged ephemeral container",
+			job: func(job *batchv1.Job) {
+				job.Spec.Template.Spec.EphemeralContainers = []corev1.EphemeralContainer{{
+					EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+						Name:            "debug",
+						Image:           "busybox",
+						SecurityContext: &corev1.SecurityContext{Privileged: ptr.To(true)},
+					},
+				}}
+			},
+			want: []string{"Job judge: spec.template.spec.ephemeralContainers[0].securityContext.privileged"},
+		},
+		{
+			name: "privilege escalation",
+			job: func(job *batchv1.Job) {
+				job.Spec.Template.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{
+					AllowPrivilegeEscalation: ptr.To(true),
+				}
+			},
+			want: []string{"Job judge: spec.template.spec.containers[0].securityContext.allowPrivilegeEscalation"},
+		},
+		{
+			name: "added capabilities",
+			job: func(job *batchv1.Job) {
+				job.Spec.Template.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{
+					Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"SYS_ADMIN", "CHOWN", "cap_sys_ptrace", "ALL"}},
+				}
+			},
+			want: []string{
+				"Job judge: spec.template.spec.containers[0].securityContext.capabilities.add[0]",
+				"Job judge: spec.template.spec.containers[0].securityContext.capabilities.add[2]",
+				"Job judge: spec.template.spec.containers[0].securityContext.capabilities.add[3]",
+			},
+		},
+		{
+			name: "unconfined pod",
+			job: func(job *batchv1.Job) {
+				job.Spec.Template.Spec.SecurityContext = &corev1.PodSecurityContext{
+					SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeUnconfined},
+					SELinuxOptions: &corev1.SELinuxOptions{User: "system_u"},
+					Sysctls: []corev1.Sysctl{
+						{Name: "net.ipv4.tcp_syncookies", Value: "1"},
+						{Name: "kernel.msgmax", Value: "65536"},
+					},
+				}
+			},
+			want: []string{
+				"Job judge: spec.template.spec.securityContext.sysctls[1]",
+				"Job judge: spec.template.spec.securityContext.seccompProfile",
+				"Job judge: spec.template.spec.securityContext.seLinuxOptions",
+			},
+		},
+		{
+			name: "unconfined container",
+			job: func(job *batchv1.Job) {
+				job.Spec.Template.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{
+					ProcMount:       ptr.To(corev1.UnmaskedProcMount),
+					AppArmorProfile: &corev1.AppArmorProfile{Type: corev1.AppArmorProfileTypeUnconfined},
+				}
+			},
+			want: []string{
+				"Job judge: spec.template.spec.containers[0].securityContext.procMount",
+				"Job judge: spec.template.spec.containers[0].securityContext.appArmorProfile",
+			},
+		},
+		{
+			name:   "non-root required",
+			policy: func(p *Policy) { p.RequireNonRoot = true },
+			job: func(job *batchv1.Job) {
+				job.Spec.Template.Spec.SecurityContext = &corev1.PodSecurityContext{RunAsUser: ptr.To[int64](1000)}
+				job.Spec.Template.Spec.Containers = append(job.Spec.Template.Spec.Containers, corev1.Container{
+					Name:            "root",
+					Image:           "busybox",
+					SecurityContext: &corev1.SecurityContext{RunAsUser: ptr.To[int64](0)},
+				})
+			},
+			want: []string{"Job judge: spec.template.spec.containers[1].securityContext.runAsNonRoot"},
+		},
+		{
+			name:   "limits within",
+			policy: limited,
+			job: func(job *batchv1.Job) {
+				job.Spec.Template.Spec.Containers[0].Resources.Limits = corev1.ResourceList{
+					corev1.ResourceCPU: resource.MustParse("4000m"),
+				}
+			},
+		},
+		{
+			name:   "limits exceeded",
+			policy: limited,
+			job: func(job *batchv1.Job) {
+				job.Spec.Template.Spec.Containers[0].Resources.Limits = corev1.ResourceList{
+					corev1.ResourceCPU: resource.MustParse("1000"),
+				}
+			},
+			want: []string{"Job judge: spec.template.spec.containers[0].resources.limits.cpu"},
+		},
+		{
+			name:   "limits omitted",
+			policy: limited,
+			want:   []string{"Job judge: spec.template.spec.containers[0].resources.limits.cpu"},
+		},
+		{
+			name: "requests exceeded",
+			policy: func(p *Policy) {
+				p.MaxRequests = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")}
+			},
+			job: func(job *batchv1.Job) {
+				job.Spec.Template.Spec.Containers[0].Resources.Requests = corev1.ResourceList{
+					corev1.ResourceMemory: resource.MustParse("2Gi"),
+				}
+			},
+			want: []string{"Job judge: spec.template.spec.containers[0].resources.requests.memory"},
+		},
+		{
+			name: "parallelism and completions",
+			policy: func(p *Policy) {
+				p.MaxParallelism = 4
+				p.MaxCompletions = 8
+			},
+			job: func(job *batchv1.Job) {
+				job.Spec.Parallelism = ptr.To[int32](1000)
+				job.Spec.Completions = ptr.To[int32](1000)
+			},
+			want: []string{
+				"Job judge: spec.parallelism",
+				"Job judge: spec.completions",
+			},
+		},
+		{
+			name:   "registry",
+			policy: func(p *Policy) { p.AllowedRegistries = []string{"docker.io/library"} },
+			job: func(job *batchv1.Job) {
+				job.Spec.Template.Spec.Containers = append(job.Spec.Template.Spec.Containers, corev1.Container{
+					Name:  "evil",
+					Image: "ghcr.io/evil/miner",
+				})
+			},
+			want: []string{"Job judge: spec.template.spec.containers[1].image"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := Default()
+			if tt.policy != nil {
+				tt.policy(p)
+			}
+			job := newJob()
+			if tt.job != nil {
+				tt.job(job)
+			}
+
+			got := violatedFields(t, p.CheckJob(job))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("violations are %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckObjects(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want []string
+	}{
+		{
+			name: "not a workload",
+			yaml: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+data:
+  hostNetwork: "true"
+`,
+		},
+		{
+			name: "pod",
+			yaml: `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: user
+spec:
+  hostPID: true
+  containers:
+    - name: user
+      image: busybox
+      securityContext:
+        capabilities:
+          add: [SYS_ADMIN]
+`,
+			want: []string{
+				"Pod user: spec.hostPID",
+				"Pod user: spec.containers[0].securityContext.capabilities.add[0]",
+			},
+		},
+		{
+			name: "several documents",
+			yaml: `
+apiVersion: v1
+kind: Service
+metadata:
+  name: judge
+---
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: cron
+spec:
+  schedule: "* * * * *"
+  jobTemplate:
+    spec:
+      parallelism: 100
+      template:
+        spec:
+          volumes:
+            - name: root
+              hostPath:
+                path: /
+          containers:
+            - name: cron
+              image: busybox
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 100
+  template:
+    spec:
+      containers:
+        - name: web
+          image: nginx
+`,
+			want: []string{
+				"CronJob cron: spec.jobTemplate.spec.parallelism",
+				"CronJob cron: spec.jobTemplate.spec.template.spec.volumes[0]",
+				"Deployment web: spec.replicas",
+			},
+		},
+	}
+
+	p := Default()
+	p.MaxParallelism = 10
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := violatedFields(t, p.CheckObjects(tt.yaml))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("violations are %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeImage(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{"busybox", "docker.io/library/busybox"},
+		{"busybox:1.36", "docker.io/library/busybox:1.36"},
+		{"library/busybox", "docker.io/library/busybox"},
+		{"lcpu/judge:latest", "docker.io/lcpu/judge:latest"},
+		{"docker.io/library/busybox", "docker.io/library/busybox"},
+		{"ghcr.io/lcpu-club/judge", "ghcr.io/lcpu-club/judge"},
+		{"localhost/judge", "localhost/judge"},
+		{"localhost:5000/x", "localhost:5000/x"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeImage(tt.image); got != tt.want {
+			t.Errorf("normalizeImage(%q) = %q, want %q", tt.image, got, tt.want)
+		}
+	}
+}
+
+func TestImageAllowed(t *testing.T) {
+	allowed := []string{"docker.io/library", "ghcr.io/lcpu-club/", "localhost:5000"}
+
+	tests := []struct {
+		image string
+		want  bool
+	}{
+		{"busybox", true},
+		{"docker.io/library/busybox:1.36", true},
+		{"library/busybox", true},
+		{"lcpu/judge", false},
+		{"docker.io/library-evil/busybox", false},
+		{"ghcr.io/lcpu-club/judge:v1", true},
+		{"ghcr.io/lcpu-club-evil/judge", false},
+		{"ghcr.io/evil/judge", false},
+		{"localhost:5000/x", true},
+		{"localhost:5001/x", false},
+		{"localhost/x", false},
+	}
+
+	for _, tt := range tests {
+		if got := imageAllowed(tt.image, allowed); got != tt.want {
+			t.Errorf("imageAllowed(%q) = %v, want %v", tt.image, got, tt.want)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	file := filepath.Join(dir, "policy.yaml")
+	err := os.WriteFile(file, []byte("maxParallelism: 4\nallowedCapabilities: []\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MaxParallelism != 4 || len(p.AllowedCapabilities) != 0 {
+		t.Errorf("policy is not loaded: %+v", p)
+	}
+	if !slices.Equal(p.ForbiddenVolumes, Default().ForbiddenVolumes) {
+		t.Errorf("defaults are not kept: %+v", p)
+	}
+
+	typo := filepath.Join(dir, "typo.yaml")
+	err = os.WriteFile(typo, []byte("forbidenVolumes: [hostPath]\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Load(typo)
+	if err == nil {
+		t.Error("unknown field is accepted")
+	}
+}
@@ -24,7 +24,11 @@ func loadError(res *resty.Response, err error) error {
 		apiError := &APIError{}
 		err := json.Unmarshal(res.Body(), apiError)
 		if err != nil {
-			return err
+			// Not from AOI itself, e.g. a proxy error page
+			return &APIError{
+				Message:    res.Status(),
+				StatusCode: res.StatusCode(),
+			}
 		}
 		return apiError
 	}
@@ -10,4 +10,5 @@ const (
 	StatusRuntimeError        = "Runtime Error"
 	StatusCompileError        = "Compile Error"
 	StatusInternalError       = "Internal Error"
+	StatusQueued              = "Queued"
 )
@@ -3,6 +3,7 @@ package judgerproto
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/lcpu-club/hpcgame-judger/pkg/aoiclient"
@@ -21,12 +22,41 @@ const (
 	ActionDetail   Action = "d"
 )
 
+var actionNames = map[Action]string{
+	ActionGreet:    "greet",
+	ActionNoop:     "noop",
+	ActionError:    "error",
+	ActionLog:      "log",
+	ActionComplete: "complete",
+	ActionQuit:     "quit",
+	ActionPatch:    "patch",
+	ActionDetail:   "detail",
+}
+
+// Name returns the human readable name of the action
+func (a Action) Name() string {
+	if name, ok := actionNames[a]; ok {
+		return name
+	}
+	return "unknown"
+}
+
 type Message struct {
-	Time   time.Time       `json:"t"`
+	Time time.Time `json:"t"`
+	// Seq numbers the printed messages of a judge process from 1, so that
+	// the manager can skip the ones of the process already applied, 0 if not
+	// numbered. A restarted process starts over from 1.
+	Seq    uint64          `json:"s,omitempty"`
 	Action Action          `json:"a"`
 	Body   json.RawMessage `json:"b,omitempty"`
 }
 
+var (
+	// Guards seq, so that messages are printed in order of it
+	printLock sync.Mutex
+	seq       uint64
+)
+
 type ErrorBody string
 type LogBody string
 
@@ -86,6 +116,11 @@ func (m *Message) String() string {
 }
 
 func (m *Message) Print() {
+	printLock.Lock()
+	defer printLock.Unlock()
+
+	seq++
+	m.Seq = seq
 	fmt.Println(m.String())
 }
 